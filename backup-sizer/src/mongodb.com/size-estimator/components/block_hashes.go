@@ -1,10 +1,8 @@
 package components
 
 import (
-	"bufio"
-	"compress/zlib"
+	"context"
 	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"github.com/willf/bloom"
 	"io"
@@ -19,7 +17,7 @@ import (
 
 const kb = 1024
 const blockSizeBytes = 64 * kb
-const hashSize = 65
+const hashSize = 65 // line length of the old hex text hash files
 
 func readFileNamesToChannel(dir string, storageEngine StorageEngine, errCh chan error) (fnCh chan string) {
 	files, err := getFilesInDir(dir, storageEngine, true)
@@ -38,33 +36,85 @@ func readFileNamesToChannel(dir string, storageEngine StorageEngine, errCh chan
 	return fnCh
 }
 
-func splitFiles(fname string) (func([]byte) ([]byte, error), error) {
+// fileSplitter reads a file in pieces that start at multiples of the piece size, so the blocks cut
+// from each piece are at the same file offsets in every iteration, however the reads are split up.
+type fileSplitter struct {
+	r      io.Reader
+	f      io.Closer
+	name   string
+	offset int64
+}
+
+// fileBlock is a piece of a file, holding one or more blocks of each block size.
+type fileBlock struct {
+	data   []byte
+	file   string
+	offset int64
+}
+
+func newFileSplitter(ctx context.Context, fname string, throttle *Throttle) (*fileSplitter, error) {
 	f, err := os.Open(fname)
 	if err != nil {
 		return nil, err
 	}
-	fun := func(b []byte) ([]byte, error) {
-		n, err := f.Read(b)
-		if err != nil {
-			if err == io.EOF {
-				f.Close()
-				return nil, nil
-			}
-			return nil, err
+	return &fileSplitter{r: throttle.Reader(ctx, f), f: f, name: fname}, nil
+}
+
+// Next fills b, and returns io.EOF after the last piece. Only the last piece can be shorter than b,
+// which is trimmed so smaller block sizes don't have multiple empty blocks.
+func (fs *fileSplitter) Next(b []byte) (*fileBlock, error) {
+	n, err := io.ReadFull(fs.r, b)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fb := &fileBlock{b[:n], fs.name, fs.offset}
+	fs.offset += int64(n)
+	return fb, nil
+}
+
+func (fs *fileSplitter) Close() error {
+	if fs.f != nil {
+		return fs.f.Close()
+	}
+	return nil
+}
+
+// ValidateBlockSizes checks that every block size divides the largest, so blocks cut from a piece of
+// the largest size line up with the file.
+func ValidateBlockSizes(blocksizes []int) error {
+	if len(blocksizes) == 0 {
+		return fmt.Errorf("No block sizes given")
+	}
+	max := 0
+	for _, bs := range blocksizes {
+		if bs <= 0 {
+			return fmt.Errorf("Block size %d must be positive", bs)
+		}
+		if bs > max {
+			max = bs
+		}
+	}
+	for _, bs := range blocksizes {
+		if max%bs != 0 {
+			return fmt.Errorf("Block size %d does not divide the largest block size %d", bs, max)
 		}
-		return b[:n], nil // remove padding at end of file so smaller blocksizes don't have multiple empty blocks
 	}
-	return fun, nil
+	return nil
 }
 
 type Block struct {
 	blockSize        int
-	hash             string
-	compressedSize   int
+	file             string
+	offset           int64 // in file
+	hash             []byte
+	compressedSizes  []int // one per compressor
 	uncompressedSize int
 }
 
-func hashAndCompressBlocks(b []byte, blocksize int) (*[]Block, error) {
+func hashAndCompressBlocks(b []byte, blocksize int, compressors []Compressor) (*[]Block, error) {
 	hasher := sha256.New()
 
 	blocks := make([]Block, int64(math.Ceil(float64(len(b))/float64(blocksize))))
@@ -79,13 +129,21 @@ func hashAndCompressBlocks(b []byte, blocksize int) (*[]Block, error) {
 		if err != nil {
 			return nil, err
 		}
-		hashed := hex.EncodeToString(hasher.Sum(nil))
-		compressedLen, err := getCompressedSize(slice)
-		if err != nil {
-			return nil, err
+		hashed := hasher.Sum(nil)
+		compressedLens := make([]int, len(compressors))
+		for c, compressor := range compressors {
+			compressedLens[c], err = compressor.CompressedSize(slice)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		block := Block{blocksize, hashed, compressedLen, len(slice)}
+		block := Block{
+			blockSize:        blocksize,
+			hash:             hashed,
+			compressedSizes:  compressedLens,
+			uncompressedSize: len(slice),
+		}
 		blocks[i] = block
 
 		hasher.Reset()
@@ -109,58 +167,31 @@ func (cb *CountingBuffer) Len() (n int) {
 	return cb.count
 }
 
-func getCompressedSize(block []byte) (int, error) {
-	var cb CountingBuffer
-	w := zlib.NewWriter(&cb)
-	_, err := w.Write(block)
-	if err != nil {
-		return 0, err
-	}
-	err = w.Close()
-	if err != nil {
-		return 0, err
-	}
-	return cb.Len(), nil
-}
-
-func writeHash(h Block, file *os.File) error {
-	_, err := file.WriteString(h.hash + "\n")
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func loadPrevHashes(fileName string, falsePosRate float64) (*bloom.BloomFilter, error) {
-	exists, err := CheckExists(fileName)
+// loadPrevHashes converts fileName first if it is an old text hash file. Digests are truncated to
+// digestSize bytes, which cannot be longer than the ones stored.
+func loadPrevHashes(fileName string, falsePosRate float64, digestSize int) (*bloom.BloomFilter, error) {
+	prevFile, err := openPrevHashes(fileName, digestSize)
 	if err != nil {
 		return nil, err
 	}
-	if !exists {
+	if prevFile == nil {
 		return bloom.New(10, 10), nil
 	}
+	defer prevFile.Close()
 
-	n, err := numHashes(fileName)
-	if err != nil {
-		return nil, err
-	}
-
-	m, k := bloomFilterParams(n, falsePosRate)
-
-	prevFile, err := os.Open(fileName)
-	if err != nil {
-		return nil, err
-	}
-	scanner := bufio.NewScanner(prevFile)
-
+	m, k := bloomFilterParams(prevFile.Header.Count, falsePosRate)
 	bloomFilter := bloom.New(m, k)
 
-	for scanner.Scan() {
-		h := scanner.Text()
-		bloomFilter.AddString(h)
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	var digest []byte
+	for {
+		digest, err = prevFile.Next(digest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		bloomFilter.Add(digest[:digestSize])
 	}
 	return bloomFilter, nil
 }
@@ -168,12 +199,41 @@ func loadPrevHashes(fileName string, falsePosRate float64) (*bloom.BloomFilter,
 type AllBlockSizeStats map[int]*BlockStats
 
 type BlockStats struct {
-	compressedTotal      int
-	uncompressedTotal    int
-	totalHashes          int
-	totalDupeCount       int
-	DedupRate            float64
-	DataCompressionRatio float64
+	compressedTotals     []int // one per compressor
+	bloomDupeCount       int
+	intraDupeCount       int
+	windowDupeCounts     []int // by how many iterations ago the block was last seen
+	bloomDupeCounts      []int
+	DedupRate            float64 // measured with the chosen DedupMode, against the whole dedup window
+	BloomDedupRate       float64 // estimated with the Bloom filter, whatever the DedupMode
+	IntraDedupRate       float64 // blocks repeated within this iteration, e.g. zeroed pages
+	DataCompressionRatio float64 // with the first compressor
+	TotalHashes          int
+	TotalDupeCount       int // blocks found in the dedup window
+	UncompressedTotal    int
+	CompressedTotal      int // with the first compressor
+	// blocks not found in the dedup window, which a snapshot has to store
+	NewBlocks          int
+	NewCompressedBytes int64
+	// NewCompressedBytes extrapolated from the time between iterations. 0 in the first iteration,
+	// which has nothing to dedup against.
+	CompressedGbPerDay float64
+	// compression ratio of every compressor measured, by name
+	CompressionRatios map[string]float64 `json:",omitempty"`
+	// WindowDedupRates[i] is the dedup rate against the last i+1 iterations that have hashes
+	WindowDedupRates []float64 `json:",omitempty"`
+	// no earlier iteration in the dedup window left hashes, so the dedup rates are meaningless
+	NoPrevHashes bool `json:",omitempty"`
+	// only with opts.Breakdown, see NewBreakdown
+	files map[string]*fileCounts
+}
+
+func sum(counts []int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
 }
 
 func CheckExists(path string) (bool, error) {
@@ -189,6 +249,15 @@ func CheckExists(path string) (bool, error) {
 
 // fn stores hashes from previous iteration
 func numHashes(fn string) (int64, error) {
+	hashFile, err := OpenHashFile(fn)
+	if err == nil {
+		hashFile.Close()
+		return hashFile.Header.Count, nil
+	}
+	if err != NotHashFileError {
+		return 0, err
+	}
+
 	fi, err := os.Stat(fn)
 	if err != nil {
 		return 0, err
@@ -197,6 +266,19 @@ func numHashes(fn string) (int64, error) {
 	return size / hashSize, nil
 }
 
+// expectedBlocks is the number of blocks of blocksize in files, which are split separately.
+func expectedBlocks(files []string, blocksize int) (int64, error) {
+	var n int64
+	for _, fname := range files {
+		fi, err := os.Stat(fname)
+		if err != nil {
+			return 0, err
+		}
+		n += (fi.Size() + int64(blocksize) - 1) / int64(blocksize)
+	}
+	return n, nil
+}
+
 // n is the size of the set, p is the false positive rate
 // calculated as explained in http://www.cs.utexas.edu/users/lam/386p/slides/Bloom%20Filters.pdf
 func bloomFilterParams(n int64, p float64) (m, k uint) {
@@ -215,19 +297,51 @@ func bloomFilterParams(n int64, p float64) (m, k uint) {
 	return
 }
 
-func GetBlockHashes(opts *BackupSizingOpts, dbpath string, blocksizes []int, iteration int) (*AllBlockSizeStats,
-	error) {
+// collectErrors reads errCh until it is closed, then sends finalErr a summary of the errors, if any,
+// and closes it.
+func collectErrors(errCh chan error, finalErr chan error) {
+	const maxErrors = 5
+	errors := make([]byte, 0)
+	numErrors := 0
+
+	for {
+		e := <-errCh
+		if e == nil {
+			break
+		}
+		numErrors++
+		s := fmt.Sprintf("Error %d: %v\n", numErrors, e.Error())
+		if numErrors <= maxErrors {
+			errors = append(errors, []byte(s)...)
+		}
+	}
+	s := fmt.Sprintf("Encountered %d errors. Printing first %d.\n", numErrors, maxErrors)
+	errors = append([]byte(s), errors...)
+
+	if numErrors > 0 {
+		finalErr <- fmt.Errorf(string(errors))
+	}
+	close(finalErr)
+}
 
-	const numFileSplitters = 3
-	const numBlockHashers = 3
+// GetBlockHashes stops reading when ctx is done, removes the iteration's hash files and returns ctx's
+// error. The hash files are also removed when any file fails to be read, so the next iteration is not
+// compared with partial hashes.
+func GetBlockHashes(ctx context.Context, opts *BackupSizingOpts, dbpath string, blocksizes []int,
+	iteration int) (*AllBlockSizeStats, error) {
+
+	numFileSplitters := opts.numSplitters()
+	numBlockHashers := opts.numHashers()
+	throttle := NewThrottle(opts.MaxReadMBps)
 
 	hashpath := opts.HashDir
-	bfFalsePos := opts.FalsePosRate
+	compressors := opts.blockCompressors()
+	if err := ValidateBlockSizes(blocksizes); err != nil {
+		return nil, err
+	}
 
 	sort.Ints(blocksizes)
 	maxBlockSize := blocksizes[len(blocksizes)-1] // largest block size
-	bloomFilters := make(map[int]*bloom.BloomFilter)
-	hashFiles := make(map[int]*os.File)
 
 	dbpath, err := filepath.Abs(dbpath)
 	if err != nil {
@@ -239,79 +353,62 @@ func GetBlockHashes(opts *BackupSizingOpts, dbpath string, blocksizes []int, ite
 	if err != nil {
 		return nil, err
 	}
-	hashpath += "/"
 
-	for _, s := range blocksizes {
-		path := hashpath + strconv.Itoa(s)
-		exists, err := CheckExists(path)
+	storageEngine, err := opts.GetStorageEngine()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get storage engine for session on port %s. Err: %v", opts.SafeUri(), err)
+	}
+	var files []string
+	if opts.dedupMode() == DedupBloom {
+		files, err = getFilesInDir(dbpath, storageEngine, true)
 		if err != nil {
 			return nil, err
 		}
-		if !exists {
-			err = os.MkdirAll(path, 0777)
+	}
+
+	tallies := make(map[int]*blockTally)
+	for _, s := range blocksizes {
+		var n int64
+		if files != nil {
+			n, err = expectedBlocks(files, s)
 			if err != nil {
-				return nil, err
+				return nil, abortTallies(tallies, err)
 			}
 		}
-		path += "/"
-
-		hashFileName := strconv.AppendInt([]byte(path), int64(iteration), 10)
-		hashFile, err := os.Create(string(hashFileName))
+		tally, err := newBlockTally(opts, hashpath, strconv.Itoa(s), s, iteration, n)
 		if err != nil {
-			return nil, fmt.Errorf("Failed creating file %s to write hashes, iteration %d. Err: %v",
-				string(hashFileName), iteration, err)
+			return nil, abortTallies(tallies, err)
 		}
-		hashFiles[s] = hashFile
+		tallies[s] = tally
+		if opts.Breakdown && s == blocksizes[0] {
+			tallies[s].stat.files = make(map[string]*fileCounts)
+		}
+	}
 
-		prevHashFileName := string(strconv.AppendInt([]byte(path), int64(iteration-1), 10))
-		bloomFilter, err := loadPrevHashes(prevHashFileName, bfFalsePos)
+	var totalBytes int64
+	if opts.ProgressFunc != nil {
+		totalBytes, err = sumDirFiles(dbpath, storageEngine, true)
 		if err != nil {
-			return nil, fmt.Errorf("Failed loading previous hashes from %s, iteration %d. Err: %v",
-				string(strconv.AppendInt([]byte(dbpath), int64(iteration-1), 10)), iteration, err)
+			return nil, abortTallies(tallies, err)
 		}
-		bloomFilters[s] = bloomFilter
 	}
 
 	errCh := make(chan error)
 	finalErr := make(chan error)
 
-	go func() {
-		const maxErrors = 5
-		errors := make([]byte, 0)
-		numErrors := 0
-
-		for {
-			e := <-errCh
-			if e == nil {
-				break
-			}
-			numErrors++
-			s := fmt.Sprintf("Error %d: %v\n", numErrors, e.Error())
-			if numErrors <= maxErrors {
-				errors = append(errors, []byte(s)...)
-			}
-		}
-		s := fmt.Sprintf("Encountered %d errors. Printing first %d.\n", numErrors, maxErrors)
-		errors = append([]byte(s), errors...)
-
-		if numErrors > 0 {
-			finalErr <- fmt.Errorf(string(errors))
-		}
-		close(finalErr)
-	}()
+	go collectErrors(errCh, finalErr)
 
 	// load up all the filenames into fnCh
-	storageEngine, err := opts.GetStorageEngine()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get storage engine for session on port %s. Err: %v", opts.Uri, err)
-	}
 	fnCh := readFileNamesToChannel(dbpath, storageEngine, errCh)
+	// nothing has been taken from fnCh yet
+	progress := newProgressTracker(opts.ProgressFunc, opts.ProgressInterval, ComponentBlocks, len(fnCh),
+		totalBytes)
 
 	// numFileSplitters + len(blocksCh) + numBlockHashers  max number of slices that can be in use at one time
 	numSlices := numFileSplitters*2 + numBlockHashers
 
 	emptyBlocksCh := make(chan []byte, numSlices)
-	blocksCh := make(chan []byte, numFileSplitters)
+	blocksCh := make(chan *fileBlock, numFileSplitters)
 	hashCh := make(chan Block, numBlockHashers)
 	crResChan := make(chan AllBlockSizeStats)
 
@@ -329,30 +426,34 @@ func GetBlockHashes(opts *BackupSizingOpts, dbpath string, blocksizes []int, ite
 			defer blocksWG.Done()
 			for {
 				fname := <-fnCh
-				if fname == "" {
+				if fname == "" || ctx.Err() != nil {
 					break
 				}
 
-				blocks, err := splitFiles(fname)
+				splitter, err := newFileSplitter(ctx, fname, throttle)
 				if err != nil {
 					errCh <- err
-					break
+					progress.fileDone()
+					continue
 				}
-				for {
+				for ctx.Err() == nil {
 					b := <-emptyBlocksCh
 					if len(b) != maxBlockSize || cap(b) != maxBlockSize {
 						b = b[:cap(b)]
 					}
-					block, err := blocks(b)
-					if block == nil {
-						if err != nil {
-							errCh <- err
+					block, err := splitter.Next(b)
+					if err != nil {
+						if err != io.EOF {
+							errCh <- fmt.Errorf("Failed reading %s. Err: %v", fname, err)
 						}
 						emptyBlocksCh <- b
 						break
 					}
+					progress.read(len(block.data))
 					blocksCh <- block
 				}
+				splitter.Close()
+				progress.fileDone()
 			}
 		}()
 	}
@@ -362,60 +463,51 @@ func GetBlockHashes(opts *BackupSizingOpts, dbpath string, blocksizes []int, ite
 		go func() {
 			defer hashWG.Done()
 			for {
-				b := <-blocksCh
-				if b == nil {
+				fb := <-blocksCh
+				if fb == nil {
 					return
 				}
 
 				for _, bs := range blocksizes {
-					hashed, err := hashAndCompressBlocks(b, bs)
+					hashed, err := hashAndCompressBlocks(fb.data, bs, compressors)
 					if err != nil {
 						errCh <- err
 					} else {
-						for _, h := range *hashed {
+						for i, h := range *hashed {
+							h.file = fb.file
+							h.offset = fb.offset + int64(i*bs)
 							hashCh <- h
 						}
 					}
 				}
-				emptyBlocksCh <- b
+				emptyBlocksCh <- fb.data
 			}
 		}()
 	}
 
 	go func() {
-		allStats := AllBlockSizeStats{}
-		for _, bs := range blocksizes {
-			allStats[bs] = &BlockStats{}
-		}
-
 		for {
 			h, open := <-hashCh
 			if !open {
 				break
 			}
-			blocksize := h.blockSize
-			stat := allStats[blocksize]
-
-			stat.totalHashes++
-			stat.compressedTotal += h.compressedSize
-			stat.uncompressedTotal += h.uncompressedSize
-
-			hashFile := hashFiles[blocksize]
-			err := writeHash(h, hashFile)
-			if err != nil {
+			if err := tallies[h.blockSize].add(&h); err != nil {
 				errCh <- err
 			}
-
-			bloomFilter := bloomFilters[blocksize]
-			if bloomFilter.TestString(h.hash) {
-				stat.totalDupeCount++
-			}
 		}
 
+		allStats := AllBlockSizeStats{}
 		for _, bs := range blocksizes {
-			stat := allStats[bs]
-			stat.DataCompressionRatio = float64(stat.uncompressedTotal) / float64(stat.compressedTotal)
-			stat.DedupRate = float64(stat.totalDupeCount) / float64(stat.totalHashes)
+			if ctx.Err() != nil {
+				if err := tallies[bs].abort(); err != nil {
+					errCh <- err
+				}
+				continue
+			}
+			if err := tallies[bs].finish(); err != nil {
+				errCh <- err
+			}
+			allStats[bs] = tallies[bs].stat
 		}
 		crResChan <- allStats
 		return
@@ -429,16 +521,30 @@ func GetBlockHashes(opts *BackupSizingOpts, dbpath string, blocksizes []int, ite
 	close(emptyBlocksCh)
 
 	res := <-crResChan
+	progress.finish()
 	close(errCh)
 
 	err = <-finalErr
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		return nil, err
+		return nil, abortTallies(tallies, err)
 	}
 
 	return &res, nil
 }
 
+// abortTallies removes the hash files of a failed iteration, and adds any failure to do so to err.
+func abortTallies(tallies map[int]*blockTally, err error) error {
+	for _, t := range tallies {
+		if abortErr := t.abort(); abortErr != nil {
+			err = fmt.Errorf("%v\nFailed removing the hashes of %s. Err: %v", err, t.name, abortErr)
+		}
+	}
+	return err
+}
+
 /*
 For a 5G data file
 	Size hash file 	num hashes 	 err rate 	 m 	 	k 	 size of bloomfilter
@@ -466,7 +572,7 @@ func getBloomFilterSizes(hashfile string) ([]int64, error) {
 
 	for i, fp := range rates {
 		m, k := bloomFilterParams(n, fp)
-		bf, err := loadPrevHashes(hashfile, fp)
+		bf, err := loadPrevHashes(hashfile, fp, sha256.Size)
 		if err != nil {
 			return nil, err
 		}
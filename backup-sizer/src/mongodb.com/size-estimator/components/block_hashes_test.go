@@ -1,13 +1,21 @@
 package components
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"testing"
+	"time"
 )
 
 const TestDataDir = "../../../../test_data"
@@ -57,7 +65,7 @@ func testBlockHashes(dbpath string) (err error) {
 		NumCPUs:      runtime.NumCPU(),
 	}
 
-	bs, err := GetBlockHashes(&opts, dbpath, blocksizes, 0)
+	bs, err := GetBlockHashes(context.Background(), &opts, dbpath, blocksizes, 0)
 	if err != nil {
 		return
 	}
@@ -65,7 +73,7 @@ func testBlockHashes(dbpath string) (err error) {
 		return fmt.Errorf("Returned nil")
 	}
 
-	bs, err = GetBlockHashes(&opts, dbpath, blocksizes, 1)
+	bs, err = GetBlockHashes(context.Background(), &opts, dbpath, blocksizes, 1)
 	if err != nil {
 		return fmt.Errorf("Second iteration: %v", err)
 	}
@@ -83,6 +91,29 @@ func TestDirectory(test *testing.T) {
 	}
 }
 
+func TestOfflineDirectory(test *testing.T) {
+	opts := BackupSizingOpts{
+		FalsePosRate:  0.01,
+		HashDir:       "hashes",
+		NumCPUs:       runtime.NumCPU(),
+		Offline:       true,
+		DbPath:        TestDataDir,
+		StorageEngine: mmap,
+	}
+
+	for iter := 0; iter < 2; iter++ {
+		bs, err := GetBlockHashes(context.Background(), &opts, opts.DbPath, blocksizes, iter)
+		if err != nil {
+			test.Fatalf("Error testing offline path %s, iteration %d. Err: %v", opts.DbPath, iter, err)
+		}
+		// the directory doesn't change, so every block of the second iteration is a duplicate
+		stat := (*bs)[blocksizes[0]]
+		if iter == 1 && stat.DedupRate != 1 {
+			test.Errorf("Expected dedup rate 1 for unchanged directory. Received %f", stat.DedupRate)
+		}
+	}
+}
+
 func TestBasic(test *testing.T) {
 	session := dial(wt_port_custPath)
 
@@ -180,31 +211,77 @@ func TestSplitFiles(test *testing.T) {
 		test.Fatalf(err.Error())
 	}
 	for _, fn := range fns {
-		blocks, err := splitFiles(fn)
+		splitter, err := newFileSplitter(context.Background(), fn, nil)
 		if err != nil {
 			test.Errorf("Failed to split file %s into blocks. Error: %v", fn, err)
+			continue
 		}
-		fn = filepath.Base(fn)
+		name := filepath.Base(fn)
 
 		fileNumBlocks := 0
 		for {
 			b := make([]byte, blockSizeBytes)
-			block, err := blocks(b)
-			if block == nil {
-				if err != nil {
-					test.Errorf("Failed to get block from splitFiles for file %s. Error: %v", fn, err)
+			block, err := splitter.Next(b)
+			if err != nil {
+				if err != io.EOF {
+					test.Errorf("Failed to get block from splitter for file %s. Error: %v", name, err)
 				}
 				break
 			}
+			if block.file != fn || block.offset != int64(fileNumBlocks*blockSizeBytes) {
+				test.Errorf("Unexpected position of block %d of %s: %s at %d", fileNumBlocks, name, block.file,
+					block.offset)
+			}
 			fileNumBlocks++
 		}
-		if fileNumBlocks != numBlocks[fn] {
-			test.Errorf("Unexpected number of blocks for file %s. Expected: %d, Received:%d", fn, numBlocks[fn],
-				fileNumBlocks)
+		splitter.Close()
+		if fileNumBlocks != numBlocks[name] {
+			test.Errorf("Unexpected number of blocks for file %s. Expected: %d, Received:%d", name,
+				numBlocks[name], fileNumBlocks)
 		}
 	}
 }
 
+// a reader that returns a few bytes at a time, like a pipe or network file system might
+type shortReader struct {
+	r io.Reader
+}
+
+func (sr shortReader) Read(b []byte) (int, error) {
+	if len(b) > 1000 {
+		b = b[:1000]
+	}
+	return sr.r.Read(b)
+}
+
+func TestSplitterAlignment(test *testing.T) {
+	// 320kb, read 1000 bytes at a time
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20*kb)
+	splitter := &fileSplitter{r: shortReader{bytes.NewReader(data)}, name: "short"}
+
+	sizes := make([]int, 0)
+	for {
+		block, err := splitter.Next(make([]byte, 128*kb))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			test.Fatalf("Failed to read. Err: %v", err)
+		}
+		sizes = append(sizes, len(block.data))
+	}
+	if len(sizes) != 3 || sizes[0] != 128*kb || sizes[1] != 128*kb || sizes[2] != 64*kb {
+		test.Errorf("Expected pieces of 128kb, 128kb and 64kb. Received %v", sizes)
+	}
+
+	if err := ValidateBlockSizes([]int{64 * kb, 96 * kb, 128 * kb}); err == nil {
+		test.Errorf("Expected error for a block size that does not divide the largest")
+	}
+	if err := ValidateBlockSizes(blocksizes); err != nil {
+		test.Errorf("Unexpected error for block sizes %v. Err: %v", blocksizes, err)
+	}
+}
+
 func TestHashAndCompressBlocks(test *testing.T) {
 	hashes := map[string][]string{
 		"empty.test":            emptyHash,
@@ -226,13 +303,13 @@ func TestHashAndCompressBlocks(test *testing.T) {
 				test.Fatalf(err.Error())
 			}
 		}
-		blocks, err := hashAndCompressBlocks(b, blocksizes[0])
+		blocks, err := hashAndCompressBlocks(b, blocksizes[0], []Compressor{DefaultBlockCompressor})
 		if err != nil {
 			test.Errorf(err.Error())
 		}
 
 		for i, block := range *blocks {
-			h := block.hash
+			h := hex.EncodeToString(block.hash)
 			exp := hashes[fn][i]
 			if h != exp {
 				test.Errorf("Incorrect hash for file %s. Expected:%s Received:%s", fn, exp, h)
@@ -261,29 +338,220 @@ func TestBloomFilterParams(test *testing.T) {
 func TestLoadPrevHashes(test *testing.T) {
 	fn := "./DoesNotExist"
 	falsePosRate := 0.01
-	_, err := loadPrevHashes(fn, falsePosRate)
+	_, err := loadPrevHashes(fn, falsePosRate, sha256.Size)
 	if err != nil {
 		test.Errorf("Unexpected error from loading non-existant file %s. Error: %v", fn, err)
 	}
 
 	// empty file -- empty bloom filter
 	fn = TestDataDir + "/empy.test"
-	_, err = loadPrevHashes(fn, falsePosRate)
+	_, err = loadPrevHashes(fn, falsePosRate, sha256.Size)
 	if err != nil {
 		test.Errorf("Unexpected error from loading empty file %s. Error: %v", fn, err)
 	}
 
 	// reading from directory should return an error
 	fn = TestDataDir
-	_, err = loadPrevHashes(fn, falsePosRate)
+	_, err = loadPrevHashes(fn, falsePosRate, sha256.Size)
 	if err == nil {
 		test.Errorf("Expected error from loading directory %s", fn)
 	}
 
 	fn = TestDataDir + "/empy.test"
-	_, err = loadPrevHashes(fn, falsePosRate)
+	_, err = loadPrevHashes(fn, falsePosRate, sha256.Size)
 	if err != nil {
 		test.Errorf("Unexpected error from loading file %s. Error: %v", fn, err)
 	}
 
 }
+
+func TestNewBlocks(test *testing.T) {
+	dataDir, cleanupDataDir := tempDir(test, "data")
+	defer cleanupDataDir()
+
+	data := make([]byte, mb)
+	rand.New(rand.NewSource(1)).Read(data)
+	changed := append([]byte{}, data...)
+	rand.New(rand.NewSource(2)).Read(changed[:mb/4])
+	fn := filepath.Join(dataDir, "collection-0-1.wt")
+
+	for _, mode := range []DedupMode{DedupBloom, DedupExact, DedupSorted} {
+		hashDir, cleanupHashDir := tempDir(test, "hashes")
+		defer cleanupHashDir()
+
+		opts := BackupSizingOpts{
+			FalsePosRate:  0.01,
+			DedupMode:     mode,
+			HashDir:       hashDir,
+			SleepTime:     6 * time.Hour,
+			NumCPUs:       runtime.NumCPU(),
+			Offline:       true,
+			DbPath:        dataDir,
+			StorageEngine: wiredTiger,
+		}
+
+		for iter, contents := range [][]byte{data, changed} {
+			ioutil.WriteFile(fn, contents, 0666)
+			bs, err := GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb}, iter)
+			if err != nil {
+				test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+			}
+			stat := (*bs)[64*kb]
+
+			if stat.TotalHashes != 16 || stat.UncompressedTotal != mb || stat.CompressedTotal <= 0 {
+				test.Errorf("Expected 16 blocks of %d bytes in %s mode. Received %+v", mb, mode, stat)
+			}
+			if stat.NewBlocks != stat.TotalHashes-stat.TotalDupeCount {
+				test.Errorf("Expected %d new blocks in %s mode. Received %d", stat.TotalHashes-stat.TotalDupeCount,
+					mode, stat.NewBlocks)
+			}
+
+			if iter == 0 {
+				if stat.NewBlocks != 16 || stat.NewCompressedBytes != int64(stat.CompressedTotal) {
+					test.Errorf("Expected every block to be new in the first iteration in %s mode. Received %+v",
+						mode, stat)
+				}
+				if stat.CompressedGbPerDay != 0 {
+					test.Errorf("Expected no growth rate in the first iteration in %s mode. Received %f", mode,
+						stat.CompressedGbPerDay)
+				}
+				continue
+			}
+
+			// Bloom filter false positives can only hide new blocks
+			if stat.NewBlocks > 4 || (mode != DedupBloom && stat.NewBlocks != 4) {
+				test.Errorf("Expected 4 new blocks in %s mode. Received %d", mode, stat.NewBlocks)
+			}
+			// random data barely compresses
+			newBytes := int64(stat.NewBlocks * 64 * kb)
+			if stat.NewCompressedBytes < newBytes || stat.NewCompressedBytes > newBytes*2 {
+				test.Errorf("Expected about %d new compressed bytes in %s mode. Received %d", newBytes, mode,
+					stat.NewCompressedBytes)
+			}
+			expected := float64(stat.NewCompressedBytes) / bytesPerGB * 4
+			if math.Abs(stat.CompressedGbPerDay-expected) > 1e-12 {
+				test.Errorf("Expected %f compressed GB/day in %s mode. Received %f", expected, mode,
+					stat.CompressedGbPerDay)
+			}
+		}
+	}
+}
+
+func TestCancelBlockHashes(test *testing.T) {
+	dataDir, hashDir, cleanup := tempDirs(test)
+	defer cleanup()
+
+	ioutil.WriteFile(filepath.Join(dataDir, "collection-0-1.wt"), make([]byte, 4*mb), 0666)
+	for _, mode := range []DedupMode{DedupBloom, DedupSorted} {
+		opts := BackupSizingOpts{
+			FalsePosRate:  0.01,
+			DedupMode:     mode,
+			HashDir:       filepath.Join(hashDir, string(mode)),
+			NumCPUs:       runtime.NumCPU(),
+			Offline:       true,
+			DbPath:        dataDir,
+			StorageEngine: wiredTiger,
+			Chunking:      NewChunkParams(0, 64*kb, 0),
+		}
+		opts.MaxReadMBps = 0
+		if _, err := GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb}, 0); err != nil {
+			test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+		}
+		if _, err := GetChunkHashes(context.Background(), &opts, dataDir, 0); err != nil {
+			test.Fatalf("Failed to chunk %s in %s mode. Err: %v", dataDir, mode, err)
+		}
+
+		// about 2s for the whole file
+		opts.MaxReadMBps = 2
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err := GetBlockHashes(ctx, &opts, dataDir, []int{64 * kb}, 1)
+		if err != context.DeadlineExceeded {
+			test.Errorf("Expected %v in %s mode. Received %v", context.DeadlineExceeded, mode, err)
+		}
+		_, err = GetChunkHashes(ctx, &opts, dataDir, 1)
+		if err != context.DeadlineExceeded {
+			test.Errorf("Expected %v chunking in %s mode. Received %v", context.DeadlineExceeded, mode, err)
+		}
+		cancel()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			test.Errorf("Expected to stop soon after the deadline in %s mode. Took %v", mode, elapsed)
+		}
+
+		// only the finished iteration is left
+		for _, dir := range []string{strconv.Itoa(64 * kb), opts.Chunking.Name()} {
+			files, _ := ioutil.ReadDir(filepath.Join(opts.HashDir, dir))
+			names := make([]string, 0)
+			for _, fi := range files {
+				names = append(names, fi.Name())
+			}
+			if len(names) == 0 || names[0] != "0" || (len(names) > 1 && names[1] != "0"+sortedHashSuffix) ||
+				len(names) > 2 {
+				test.Errorf("Expected only the hashes of iteration 0 in %s in %s mode. Received %v", dir, mode,
+					names)
+			}
+		}
+	}
+}
+
+func TestFailedBlockHashes(test *testing.T) {
+	dataDir, hashDir, cleanup := tempDirs(test)
+	defer cleanup()
+
+	data := make([]byte, mb)
+	rand.New(rand.NewSource(1)).Read(data)
+	ioutil.WriteFile(filepath.Join(dataDir, "collection-0-1.wt"), data, 0666)
+	// a file that is listed, but fails to open
+	broken := filepath.Join(dataDir, "collection-2-1.wt")
+
+	for _, mode := range []DedupMode{DedupBloom, DedupExact, DedupSorted} {
+		opts := BackupSizingOpts{
+			FalsePosRate:  0.01,
+			DedupMode:     mode,
+			HashDir:       filepath.Join(hashDir, string(mode)),
+			NumCPUs:       runtime.NumCPU(),
+			Offline:       true,
+			DbPath:        dataDir,
+			StorageEngine: wiredTiger,
+			SleepTime:     time.Hour,
+		}
+		hash := func(iteration int, fail bool) (*BlockStats, error) {
+			os.Remove(broken)
+			if fail {
+				os.Symlink(filepath.Join(dataDir, "missing"), broken)
+			}
+			bs, err := GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb}, iteration)
+			if err != nil {
+				return nil, err
+			}
+			return (*bs)[64*kb], nil
+		}
+
+		if _, err := hash(0, true); err == nil {
+			test.Fatalf("Expected error with an unreadable file in %s mode", mode)
+		}
+		stat, err := hash(1, false)
+		if err != nil {
+			test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+		}
+		if !stat.NoPrevHashes || stat.CompressedGbPerDay != 0 {
+			test.Errorf("Expected no previous hashes after a failed iteration in %s mode. Received %+v", mode, stat)
+		}
+
+		if _, err := hash(2, true); err == nil {
+			test.Fatalf("Expected error with an unreadable file in %s mode", mode)
+		}
+		if exists, _ := CheckExists(filepath.Join(opts.HashDir, strconv.Itoa(64*kb), "2")); exists {
+			test.Errorf("Expected the failed iteration's hashes to be removed in %s mode", mode)
+		}
+
+		// compared with iteration 1 only
+		stat, err = hash(3, false)
+		if err != nil {
+			test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+		}
+		if stat.NoPrevHashes || stat.DedupRate != 1 || len(stat.WindowDedupRates) != 1 {
+			test.Errorf("Expected dedup rate 1 against one iteration in %s mode. Received %+v", mode, stat)
+		}
+	}
+}
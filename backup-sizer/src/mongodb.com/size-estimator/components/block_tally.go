@@ -0,0 +1,296 @@
+package components
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/willf/bloom"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// blockTally counts the blocks of one block size, or of the content defined chunker, in an
+// iteration. Their hashes go to hashDir/<name>/<iteration> and are compared with those of the
+// previous iterations in the dedup window that have hashes.
+type blockTally struct {
+	name        string
+	stat        *BlockStats
+	compressors []Compressor
+	digestSize  int
+	dedupMode   DedupMode
+	window      int           // previous iterations with hashes
+	interval    time.Duration // between iterations
+	iteration   int
+
+	// compressed size of the blocks not in the dedup window, unless in sorted mode
+	newCompressedTotal int64
+
+	hashFile          *HashWriter
+	prevHashFileNames []string // newest first
+	bloomFilters      []*bloom.BloomFilter
+	prevHashAges      hashAges // exact mode only
+	// blocks seen so far in this iteration
+	intraFilter *bloom.BloomFilter // bloom mode only
+	intraSet    hashSet            // exact mode only
+}
+
+func (opts *BackupSizingOpts) digestSize() int {
+	if opts.DigestSize == 0 {
+		return sha256.Size
+	}
+	return opts.DigestSize
+}
+
+func (opts *BackupSizingOpts) dedupMode() DedupMode {
+	if opts.DedupMode == "" {
+		return DedupBloom
+	}
+	return opts.DedupMode
+}
+
+func (opts *BackupSizingOpts) blockCompressors() []Compressor {
+	if len(opts.BlockCompressors) == 0 {
+		return []Compressor{DefaultBlockCompressor}
+	}
+	return opts.BlockCompressors
+}
+
+func (opts *BackupSizingOpts) numSplitters() int {
+	if opts.NumSplitters <= 0 {
+		return 3
+	}
+	return opts.NumSplitters
+}
+
+func (opts *BackupSizingOpts) numHashers() int {
+	switch {
+	case opts.NumHashers > 0:
+		return opts.NumHashers
+	case opts.NumCPUs > 0:
+		return opts.NumCPUs
+	}
+	return 3
+}
+
+// dedupWindow is the number of previous iterations blocks of iteration are compared with.
+func (opts *BackupSizingOpts) dedupWindow(iteration int) int {
+	if opts.DedupWindow > 0 && opts.DedupWindow < iteration {
+		return opts.DedupWindow
+	}
+	return iteration
+}
+
+// newBlockTally loads the previous iterations' hashes. expectedBlocks sizes the Bloom filter used to
+// find blocks repeated within the iteration.
+func newBlockTally(opts *BackupSizingOpts, hashDir string, name string, blockSize int, iteration int,
+	expectedBlocks int64) (*blockTally, error) {
+
+	t := &blockTally{
+		name:        name,
+		compressors: opts.blockCompressors(),
+		digestSize:  opts.digestSize(),
+		dedupMode:   opts.dedupMode(),
+		interval:    opts.SleepTime,
+		iteration:   iteration,
+	}
+
+	path := filepath.Join(hashDir, name)
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return nil, err
+	}
+
+	window := opts.dedupWindow(iteration)
+	for age := 1; age <= window; age++ {
+		prevHashFileName := filepath.Join(path, strconv.Itoa(iteration-age))
+		exists, err := CheckExists(prevHashFileName)
+		if err != nil {
+			return nil, err
+		}
+		// a failed iteration leaves no hashes, and is not an empty snapshot to compare with
+		if !exists {
+			continue
+		}
+		t.prevHashFileNames = append(t.prevHashFileNames, prevHashFileName)
+		bloomFilter, err := loadPrevHashes(prevHashFileName, opts.FalsePosRate, t.digestSize)
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading previous hashes from %s, iteration %d. Err: %v",
+				prevHashFileName, iteration, err)
+		}
+		t.bloomFilters = append(t.bloomFilters, bloomFilter)
+	}
+	t.window = len(t.prevHashFileNames)
+	t.stat = &BlockStats{
+		compressedTotals: make([]int, len(t.compressors)),
+		windowDupeCounts: make([]int, t.window),
+		bloomDupeCounts:  make([]int, t.window),
+		NoPrevHashes:     iteration > 0 && t.window == 0,
+	}
+
+	switch t.dedupMode {
+	case DedupBloom:
+		m, k := bloomFilterParams(expectedBlocks, opts.FalsePosRate)
+		t.intraFilter = bloom.New(m, k)
+	case DedupExact:
+		var err error
+		t.prevHashAges, err = loadPrevHashAges(t.prevHashFileNames, t.digestSize)
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading previous hashes for %s, iteration %d. Err: %v", name,
+				iteration, err)
+		}
+		t.intraSet = hashSet{}
+	}
+
+	hashFileName := filepath.Join(path, strconv.Itoa(iteration))
+	// left over if this iteration was interrupted before
+	if err := os.Remove(hashFileName + sortedHashSuffix); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	hashFile, err := CreateHashFile(hashFileName, blockSize, iteration, t.digestSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating file %s to write hashes, iteration %d. Err: %v",
+			hashFileName, iteration, err)
+	}
+	t.hashFile = hashFile
+	return t, nil
+}
+
+func (t *blockTally) add(h *Block) error {
+	stat := t.stat
+	stat.TotalHashes++
+	for c, size := range h.compressedSizes {
+		stat.compressedTotals[c] += size
+	}
+	stat.UncompressedTotal += h.uncompressedSize
+
+	if err := t.hashFile.Write(h.hash); err != nil {
+		return err
+	}
+
+	digest := h.hash[:t.digestSize]
+	dupe := false
+	for i, bloomFilter := range t.bloomFilters {
+		if bloomFilter.Test(digest) {
+			stat.bloomDupeCounts[i]++
+			dupe = true
+			break
+		}
+	}
+
+	switch t.dedupMode {
+	case DedupBloom:
+		if t.intraFilter.Test(digest) {
+			stat.intraDupeCount++
+		} else {
+			t.intraFilter.Add(digest)
+		}
+	case DedupExact:
+		age := t.prevHashAges.Age(digest)
+		if age > 0 {
+			stat.windowDupeCounts[age-1]++
+		}
+		dupe = age > 0
+		if !t.intraSet.Add(digest) {
+			stat.intraDupeCount++
+		}
+	}
+	if !dupe {
+		t.newCompressedTotal += int64(h.compressedSizes[0])
+	}
+
+	if stat.files != nil {
+		t.addToFile(h, dupe)
+	}
+	return nil
+}
+
+func (t *blockTally) addToFile(h *Block, dupe bool) {
+	fc := t.stat.files[h.file]
+	if fc == nil {
+		fc = &fileCounts{}
+		t.stat.files[h.file] = fc
+	}
+	fc.blocks++
+	fc.bytes += int64(h.uncompressedSize)
+	fc.compressedBytes += int64(h.compressedSizes[0])
+	if dupe {
+		fc.dupeBlocks++
+	} else {
+		fc.changedBytes += int64(h.uncompressedSize)
+	}
+}
+
+// abort removes the hash files of an iteration that was interrupted or failed, so later iterations
+// don't compare with partial hashes.
+func (t *blockTally) abort() error {
+	if err := t.hashFile.Abort(); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err := os.Remove(t.hashFile.Name() + sortedHashSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// finish closes the hash file and computes the rates. In sorted mode this is when duplicates are
+// counted.
+func (t *blockTally) finish() error {
+	stat := t.stat
+	if err := t.hashFile.Close(); err != nil {
+		return err
+	}
+
+	switch t.dedupMode {
+	case DedupBloom:
+		copy(stat.windowDupeCounts, stat.bloomDupeCounts)
+	case DedupSorted:
+		dupes, err := countSortedDupes(t.prevHashFileNames, t.hashFile.Name(), t.digestSize)
+		if err != nil {
+			return fmt.Errorf("Failed comparing sorted hashes for %s. Err: %v", t.name, err)
+		}
+		stat.windowDupeCounts = dupes
+
+		repeats, err := countSortedRepeats(t.hashFile.Name() + sortedHashSuffix)
+		if err != nil {
+			return fmt.Errorf("Failed counting repeated hashes for %s. Err: %v", t.name, err)
+		}
+		stat.intraDupeCount = repeats
+	}
+
+	stat.CompressionRatios = make(map[string]float64, len(t.compressors))
+	for c, compressor := range t.compressors {
+		if stat.compressedTotals[c] > 0 {
+			stat.CompressionRatios[compressor.Name()] = float64(stat.UncompressedTotal) /
+				float64(stat.compressedTotals[c])
+		}
+	}
+	stat.DataCompressionRatio = stat.CompressionRatios[t.compressors[0].Name()]
+	stat.CompressedTotal = stat.compressedTotals[0]
+	stat.TotalDupeCount = sum(stat.windowDupeCounts)
+	stat.bloomDupeCount = sum(stat.bloomDupeCounts)
+	if stat.TotalHashes > 0 {
+		stat.DedupRate = float64(stat.TotalDupeCount) / float64(stat.TotalHashes)
+		stat.BloomDedupRate = float64(stat.bloomDupeCount) / float64(stat.TotalHashes)
+		stat.IntraDedupRate = float64(stat.intraDupeCount) / float64(stat.TotalHashes)
+
+		stat.WindowDedupRates = make([]float64, t.window)
+		dupes := 0
+		for i, n := range stat.windowDupeCounts {
+			dupes += n
+			stat.WindowDedupRates[i] = float64(dupes) / float64(stat.TotalHashes)
+		}
+	}
+
+	stat.NewBlocks = stat.TotalHashes - stat.TotalDupeCount
+	stat.NewCompressedBytes = t.newCompressedTotal
+	if t.dedupMode == DedupSorted && stat.TotalHashes > 0 {
+		// which blocks were new is only known in aggregate, so assume they compress like the rest
+		stat.NewCompressedBytes = int64(stat.CompressedTotal) * int64(stat.NewBlocks) / int64(stat.TotalHashes)
+	}
+	if t.iteration > 0 && t.interval > 0 && !stat.NoPrevHashes {
+		stat.CompressedGbPerDay = float64(stat.NewCompressedBytes) / bytesPerGB * float64(day) /
+			float64(t.interval)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package components
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// fileCounts tallies the blocks of one file. A block is a duplicate if the chosen DedupMode finds it
+// in the dedup window, except in sorted mode, where blocks are only matched after the iteration and
+// the Bloom filter's estimate is used instead.
+type fileCounts struct {
+	blocks          int
+	dupeBlocks      int
+	bytes           int64
+	changedBytes    int64
+	compressedBytes int64
+}
+
+func (fc *fileCounts) add(other *fileCounts) {
+	fc.blocks += other.blocks
+	fc.dupeBlocks += other.dupeBlocks
+	fc.bytes += other.bytes
+	fc.changedBytes += other.changedBytes
+	fc.compressedBytes += other.compressedBytes
+}
+
+type BreakdownCounts struct {
+	Blocks               int
+	Bytes                int64
+	ChangedBytes         int64 // in blocks that were not found in the dedup window
+	DedupRate            float64
+	DataCompressionRatio float64
+}
+
+func newBreakdownCounts(fc *fileCounts) BreakdownCounts {
+	counts := BreakdownCounts{
+		Blocks:       fc.blocks,
+		Bytes:        fc.bytes,
+		ChangedBytes: fc.changedBytes,
+	}
+	if fc.blocks > 0 {
+		counts.DedupRate = float64(fc.dupeBlocks) / float64(fc.blocks)
+	}
+	if fc.compressedBytes > 0 {
+		counts.DataCompressionRatio = float64(fc.bytes) / float64(fc.compressedBytes)
+	}
+	return counts
+}
+
+type FileStats struct {
+	File      string // relative to the dbpath
+	Database  string
+	Namespace string `json:",omitempty"` // WiredTiger collections and indexes only
+	BreakdownCounts
+}
+
+type DatabaseStats struct {
+	Database string
+	Files    int
+	BreakdownCounts
+}
+
+// Breakdown splits the block stats of one block size by file and by database. Both are sorted by
+// ChangedBytes, the most churned first.
+type Breakdown struct {
+	BlockSize int
+	Files     []*FileStats
+	Databases []*DatabaseStats
+}
+
+// files that do not belong to a database, like the WiredTiger metadata
+const otherDatabase = "(other)"
+
+// NewBreakdown uses the block size whose files were tracked by GetBlockHashes. idents maps WiredTiger
+// idents to namespaces, see GetIdentNamespaces. It may be nil, e.g. when running offline, in which
+// case only directoryPerDB layouts can be attributed to databases.
+func NewBreakdown(stats *AllBlockSizeStats, dbpath string, storageEngine StorageEngine,
+	idents map[string]string) (*Breakdown, error) {
+
+	var blocksize int
+	var files map[string]*fileCounts
+	for bs, stat := range *stats {
+		if stat.files != nil {
+			blocksize, files = bs, stat.files
+		}
+	}
+	if files == nil {
+		return nil, fmt.Errorf("No block size was tracked by file")
+	}
+
+	dbpath, err := filepath.Abs(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := &Breakdown{BlockSize: blocksize}
+	databases := make(map[string]*fileCounts)
+	databaseFiles := make(map[string]int)
+	for fname, fc := range files {
+		rel, err := filepath.Rel(dbpath, fname)
+		if err != nil {
+			return nil, err
+		}
+		db, ns := fileNamespace(rel, storageEngine, idents)
+		breakdown.Files = append(breakdown.Files, &FileStats{rel, db, ns, newBreakdownCounts(fc)})
+
+		if databases[db] == nil {
+			databases[db] = &fileCounts{}
+		}
+		databases[db].add(fc)
+		databaseFiles[db]++
+	}
+	for db, fc := range databases {
+		breakdown.Databases = append(breakdown.Databases,
+			&DatabaseStats{db, databaseFiles[db], newBreakdownCounts(fc)})
+	}
+
+	sort.Slice(breakdown.Files, func(i, j int) bool {
+		a, b := breakdown.Files[i], breakdown.Files[j]
+		if a.ChangedBytes != b.ChangedBytes {
+			return a.ChangedBytes > b.ChangedBytes
+		}
+		return a.File < b.File
+	})
+	sort.Slice(breakdown.Databases, func(i, j int) bool {
+		a, b := breakdown.Databases[i], breakdown.Databases[j]
+		if a.ChangedBytes != b.ChangedBytes {
+			return a.ChangedBytes > b.ChangedBytes
+		}
+		return a.Database < b.Database
+	})
+	return breakdown, nil
+}
+
+var (
+	mmapDataFile = regexp.MustCompile(`^(.+)\.(ns|[0-9]+)$`)
+	wtDataFile   = regexp.MustCompile(`^(collection|index)-.+\.wt$`)
+	// with directoryForIndexes, the ident's kind is a directory instead
+	wtSplitDataFile = regexp.MustCompile(`^[0-9]+-.+\.wt$`)
+)
+
+// fileNamespace attributes a file, relative to the dbpath, to a database and, for WiredTiger, to the
+// collection or index it holds. Anything that is not a data file, like diagnostic.data or
+// storage.bson, goes to otherDatabase.
+func fileNamespace(rel string, storageEngine StorageEngine, idents map[string]string) (db string, ns string) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	base := parts[len(parts)-1]
+
+	switch storageEngine {
+	case mmap:
+		// <db>.ns and <db>.<n>, optionally in a directory per database
+		m := mmapDataFile.FindStringSubmatch(base)
+		if m != nil && (len(parts) == 1 || (len(parts) == 2 && parts[0] == m[1])) {
+			return m[1], ""
+		}
+	case wiredTiger:
+		ident := strings.TrimSuffix(filepath.ToSlash(rel), ".wt")
+		if ns, ok := idents[ident]; ok {
+			return strings.SplitN(ns, ".", 2)[0], ns
+		}
+		// directoryPerDB, and directoryForIndexes inside it. Otherwise only the idents know the database.
+		switch {
+		case len(parts) == 2 && wtDataFile.MatchString(base):
+			return parts[0], ""
+		case len(parts) == 3 && (parts[1] == "collection" || parts[1] == "index") &&
+			wtSplitDataFile.MatchString(base):
+			return parts[0], ""
+		}
+	}
+	return otherDatabase, ""
+}
+
+// GetIdentNamespaces maps the WiredTiger ident of every collection and index to its namespace, using
+// the table uri in collStats. Indexes are named <db>.<collection>.$<index>. It is nil for other storage
+// engines.
+func GetIdentNamespaces(session *mgo.Session) (map[string]string, error) {
+	const tablePrefix = "statistics:table:"
+
+	storageEngine, err := getStorageEngine(session)
+	if err != nil {
+		return nil, err
+	}
+	if storageEngine != wiredTiger {
+		return nil, nil
+	}
+
+	dbs, err := session.DatabaseNames()
+	if err != nil {
+		return nil, err
+	}
+
+	idents := make(map[string]string)
+	for _, db := range dbs {
+		colls, err := session.DB(db).CollectionNames()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list collections in %s. Err: %v", db, err)
+		}
+		for _, coll := range colls {
+			var result struct {
+				WiredTiger struct {
+					Uri string `bson:"uri"`
+				} `bson:"wiredTiger"`
+				IndexDetails map[string]struct {
+					Uri string `bson:"uri"`
+				} `bson:"indexDetails"`
+			}
+			// views and some system collections have no stats
+			if err := session.DB(db).Run(bson.D{{"collStats", coll}}, &result); err != nil {
+				continue
+			}
+
+			ns := db + "." + coll
+			if uri := result.WiredTiger.Uri; strings.HasPrefix(uri, tablePrefix) {
+				idents[strings.TrimPrefix(uri, tablePrefix)] = ns
+			}
+			for name, index := range result.IndexDetails {
+				if strings.HasPrefix(index.Uri, tablePrefix) {
+					idents[strings.TrimPrefix(index.Uri, tablePrefix)] = ns + ".$" + name
+				}
+			}
+		}
+	}
+	return idents, nil
+}
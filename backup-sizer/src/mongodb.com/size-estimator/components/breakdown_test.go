@@ -0,0 +1,130 @@
+package components
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFileNamespace(test *testing.T) {
+	idents := map[string]string{
+		"collection-2-123":       "test.foo",
+		"index-3-123":            "test.foo.$_id_",
+		"test/collection/4-123":  "test.bar",
+		"test/index/5-123":       "test.bar.$_id_",
+		"admin/collection-6-123": "admin.system.version",
+		"collection-7-123":       "local.oplog.rs",
+	}
+
+	tests := []struct {
+		file          string
+		storageEngine StorageEngine
+		db            string
+		ns            string
+	}{
+		{"collection-2-123.wt", wiredTiger, "test", "test.foo"},
+		{"index-3-123.wt", wiredTiger, "test", "test.foo.$_id_"},
+		{"test/collection/4-123.wt", wiredTiger, "test", "test.bar"},
+		{"test/index/5-123.wt", wiredTiger, "test", "test.bar.$_id_"},
+		{"collection-7-123.wt", wiredTiger, "local", "local.oplog.rs"},
+		{"other/collection-9-123.wt", wiredTiger, "other", ""},
+		{"WiredTiger.wt", wiredTiger, otherDatabase, ""},
+		{"_mdb_catalog.wt", wiredTiger, otherDatabase, ""},
+		{"test.ns", mmap, "test", ""},
+		{"test.12", mmap, "test", ""},
+		{"test/test.0", mmap, "test", ""},
+		{"collection/8-123.wt", wiredTiger, otherDatabase, ""},
+		{"diagnostic.data/metrics.2024-01-02T03-04-05Z-00000", wiredTiger, otherDatabase, ""},
+		{"sizeStorer.wt", wiredTiger, otherDatabase, ""},
+		{"storage.bson", wiredTiger, otherDatabase, ""},
+		{"storage.bson", mmap, otherDatabase, ""},
+		{"diagnostic.data/metrics.2024-01-02T03-04-05Z-00000", mmap, otherDatabase, ""},
+		{"diagnostic.data/metrics.interim", mmap, otherDatabase, ""},
+		{"_tmp/test.0", mmap, otherDatabase, ""},
+		{"mongod.lock", mmap, otherDatabase, ""},
+	}
+	for _, t := range tests {
+		db, ns := fileNamespace(t.file, t.storageEngine, idents)
+		if db != t.db || ns != t.ns {
+			test.Errorf("Expected %s to belong to %q, %q. Received %q, %q", t.file, t.db, t.ns, db, ns)
+		}
+	}
+}
+
+func TestNewBreakdown(test *testing.T) {
+	dataDir, hashDir, cleanup := tempDirs(test)
+	defer cleanup()
+
+	if err := os.Mkdir(filepath.Join(dataDir, "test"), 0777); err != nil {
+		test.Fatalf("Failed to create directory. Err: %v", err)
+	}
+	static := make([]byte, mb)
+	rand.New(rand.NewSource(1)).Read(static)
+	busy := make([]byte, mb)
+	staticFile := filepath.Join(dataDir, "test", "collection-0-1.wt")
+	busyFile := filepath.Join(dataDir, "collection-1-1.wt")
+	ioutil.WriteFile(staticFile, static, 0666)
+
+	for _, mode := range []DedupMode{DedupBloom, DedupExact} {
+		opts := BackupSizingOpts{
+			FalsePosRate:  0.01,
+			DedupMode:     mode,
+			HashDir:       filepath.Join(hashDir, string(mode)),
+			NumCPUs:       runtime.NumCPU(),
+			Offline:       true,
+			DbPath:        dataDir,
+			StorageEngine: wiredTiger,
+			Breakdown:     true,
+		}
+
+		// every block of the busy file changes between iterations
+		var bs *AllBlockSizeStats
+		var err error
+		for iter := 0; iter < 2; iter++ {
+			rand.New(rand.NewSource(int64(iter + 2))).Read(busy)
+			ioutil.WriteFile(busyFile, busy, 0666)
+			bs, err = GetBlockHashes(context.Background(), &opts, dataDir, []int{128 * kb, 64 * kb}, iter)
+			if err != nil {
+				test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+			}
+		}
+		if (*bs)[128*kb].files != nil {
+			test.Errorf("Expected only the smallest block size to be tracked by file in %s mode", mode)
+		}
+
+		idents := map[string]string{"collection-1-1": "busy.coll"}
+		breakdown, err := NewBreakdown(bs, dataDir, wiredTiger, idents)
+		if err != nil {
+			test.Fatalf("Failed to break down %s in %s mode. Err: %v", dataDir, mode, err)
+		}
+		if breakdown.BlockSize != 64*kb {
+			test.Errorf("Expected block size %d. Received %d", 64*kb, breakdown.BlockSize)
+		}
+		if len(breakdown.Files) != 2 || len(breakdown.Databases) != 2 {
+			test.Fatalf("Expected 2 files and 2 databases in %s mode. Received %d and %d", mode,
+				len(breakdown.Files), len(breakdown.Databases))
+		}
+
+		busyStats, staticStats := breakdown.Files[0], breakdown.Files[1]
+		if busyStats.File != "collection-1-1.wt" || busyStats.Namespace != "busy.coll" ||
+			busyStats.Database != "busy" {
+			test.Errorf("Expected the busy file first. Received %+v", busyStats)
+		}
+		if staticStats.File != filepath.Join("test", "collection-0-1.wt") || staticStats.Database != "test" {
+			test.Errorf("Expected the static file in database test. Received %+v", staticStats)
+		}
+		if busyStats.Blocks != 16 || busyStats.Bytes != mb || busyStats.ChangedBytes != mb {
+			test.Errorf("Expected 16 changed blocks in the busy file in %s mode. Received %+v", mode, busyStats)
+		}
+		if staticStats.DedupRate != 1 || staticStats.ChangedBytes != 0 {
+			test.Errorf("Expected no changes in the static file in %s mode. Received %+v", mode, staticStats)
+		}
+		if breakdown.Databases[0].Database != "busy" || breakdown.Databases[0].Files != 1 {
+			test.Errorf("Expected database busy first. Received %+v", breakdown.Databases[0])
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ChunkParams configures content defined chunking. Chunk boundaries are placed where a rolling gear
+// hash of the data matches a mask, so inserting bytes only changes the chunks around the insertion,
+// unlike fixed size blocks. Avg must be a power of two. Chunking is disabled if Avg is 0.
+type ChunkParams struct {
+	Min int
+	Avg int
+	Max int
+}
+
+// NewChunkParams defaults min to a quarter and max to four times the average size.
+func NewChunkParams(min int, avg int, max int) ChunkParams {
+	if min == 0 {
+		min = avg / 4
+	}
+	if max == 0 {
+		max = avg * 4
+	}
+	return ChunkParams{min, avg, max}
+}
+
+func (params ChunkParams) Enabled() bool {
+	return params.Avg > 0
+}
+
+func (params ChunkParams) Validate() error {
+	if params.Avg <= 0 || params.Avg&(params.Avg-1) != 0 {
+		return fmt.Errorf("Average chunk size %d must be a power of two", params.Avg)
+	}
+	if params.Min <= 0 || params.Min > params.Avg || params.Max < params.Avg {
+		return fmt.Errorf("Chunk sizes must satisfy 0 < min <= avg <= max. Received %d, %d, %d", params.Min,
+			params.Avg, params.Max)
+	}
+	return nil
+}
+
+// Name is the directory under hashDir holding the chunk hashes.
+func (params ChunkParams) Name() string {
+	return fmt.Sprintf("cdc-%d", params.Avg)
+}
+
+// gearTable maps each byte to a random value. It is seeded so boundaries are the same in every run.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	r := rand.New(rand.NewSource(0x67656172))
+	for i := range table {
+		table[i] = uint64(r.Int63())<<1 | uint64(r.Int63n(2))
+	}
+	return table
+}()
+
+type Chunker struct {
+	r      io.Reader
+	params ChunkParams
+	mask   uint64
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+func NewChunker(r io.Reader, params ChunkParams) *Chunker {
+	// the top bits of the hash depend on the last 64 bytes, the bottom ones only on the last few
+	bits := uint(0)
+	for 1<<bits < params.Avg {
+		bits++
+	}
+	return &Chunker{
+		r:      r,
+		params: params,
+		mask:   uint64(params.Avg-1) << (64 - bits),
+		buf:    make([]byte, params.Max),
+	}
+}
+
+// Next returns the next chunk, which is only valid until the following call, or io.EOF at the end of
+// the data.
+func (c *Chunker) Next() ([]byte, error) {
+	// keep at least a max sized chunk buffered unless the data ends first
+	n := copy(c.buf, c.buf[c.start:c.end])
+	if !c.eof && n < len(c.buf) {
+		read, err := io.ReadFull(c.r, c.buf[n:])
+		n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cut(c.buf[:n])
+	c.start, c.end = cut, n
+	return c.buf[:cut], nil
+}
+
+func (c *Chunker) cut(data []byte) int {
+	if len(data) <= c.params.Min {
+		return len(data)
+	}
+	if len(data) > c.params.Max {
+		data = data[:c.params.Max]
+	}
+
+	var hash uint64
+	for i := c.params.Min; i < len(data); i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// GetChunkHashes splits every file in dbpath into content defined chunks, and measures their dedup
+// and compression like GetBlockHashes does for fixed size blocks, including how it stops when ctx is done
+// or a file fails to be read. It is a second read pass over dbpath, with its own progress reports.
+func GetChunkHashes(ctx context.Context, opts *BackupSizingOpts, dbpath string, iteration int) (*BlockStats,
+	error) {
+	numFileChunkers := opts.numHashers()
+	throttle := NewThrottle(opts.MaxReadMBps)
+
+	params := opts.Chunking
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	compressors := opts.blockCompressors()
+
+	hashpath, err := filepath.Abs(opts.HashDir)
+	if err != nil {
+		return nil, err
+	}
+	storageEngine, err := opts.GetStorageEngine()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get storage engine for session on port %s. Err: %v", opts.SafeUri(), err)
+	}
+	files, err := getFilesInDir(dbpath, storageEngine, true)
+	if err != nil {
+		return nil, err
+	}
+	n, err := expectedBlocks(files, params.Avg)
+	if err != nil {
+		return nil, err
+	}
+
+	tally, err := newBlockTally(opts, hashpath, params.Name(), params.Avg, iteration, n)
+	if err != nil {
+		return nil, err
+	}
+
+	var totalBytes int64
+	if opts.ProgressFunc != nil {
+		totalBytes, err = sumDirFiles(dbpath, storageEngine, true)
+		if err != nil {
+			return nil, abortTallies(map[int]*blockTally{params.Avg: tally}, err)
+		}
+	}
+	progress := newProgressTracker(opts.ProgressFunc, opts.ProgressInterval, ComponentChunks, len(files),
+		totalBytes)
+
+	errCh := make(chan error)
+	finalErr := make(chan error)
+	go collectErrors(errCh, finalErr)
+
+	fnCh := make(chan string, len(files))
+	for _, fname := range files {
+		fnCh <- fname
+	}
+	close(fnCh)
+
+	hashCh := make(chan Block, numFileChunkers)
+	var chunkWG sync.WaitGroup
+	for i := 0; i < numFileChunkers; i++ {
+		chunkWG.Add(1)
+		go func() {
+			defer chunkWG.Done()
+			for fname := range fnCh {
+				if err := chunkFile(ctx, fname, params, compressors, throttle, progress, hashCh); err != nil {
+					errCh <- err
+				}
+				progress.fileDone()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for h := range hashCh {
+			if err := tally.add(&h); err != nil {
+				errCh <- err
+			}
+		}
+		finish := tally.finish
+		if ctx.Err() != nil {
+			finish = tally.abort
+		}
+		if err := finish(); err != nil {
+			errCh <- err
+		}
+		close(done)
+	}()
+
+	chunkWG.Wait()
+	close(hashCh)
+	<-done
+	progress.finish()
+	close(errCh)
+
+	err = <-finalErr
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, abortTallies(map[int]*blockTally{params.Avg: tally}, err)
+	}
+	return tally.stat, nil
+}
+
+func chunkFile(ctx context.Context, fname string, params ChunkParams, compressors []Compressor, throttle *Throttle,
+	progress *progressTracker, hashCh chan Block) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	chunker := NewChunker(throttle.Reader(ctx, f), params)
+	var offset int64
+	for ctx.Err() == nil {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		blocks, err := hashAndCompressBlocks(chunk, len(chunk), compressors)
+		if err != nil {
+			return err
+		}
+		h := (*blocks)[0]
+		h.file = fname
+		h.offset = offset
+		progress.read(len(chunk))
+		hashCh <- h
+		offset += int64(len(chunk))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestChunkParams(test *testing.T) {
+	params := NewChunkParams(0, 64*kb, 0)
+	if params.Min != 16*kb || params.Max != 256*kb {
+		test.Errorf("Expected min 16kb and max 256kb. Received %+v", params)
+	}
+	if err := params.Validate(); err != nil {
+		test.Errorf("Unexpected error validating %+v. Err: %v", params, err)
+	}
+
+	for _, bad := range []ChunkParams{{16 * kb, 48 * kb, 256 * kb}, {0, 64 * kb, 256 * kb},
+		{16 * kb, 64 * kb, 32 * kb}} {
+		if err := bad.Validate(); err == nil {
+			test.Errorf("Expected error validating %+v", bad)
+		}
+	}
+}
+
+func readChunks(test *testing.T, data []byte, params ChunkParams) [][]byte {
+	chunker := NewChunker(bytes.NewReader(data), params)
+	chunks := make([][]byte, 0)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			test.Fatalf("Failed to chunk data. Err: %v", err)
+		}
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+}
+
+func TestChunker(test *testing.T) {
+	params := NewChunkParams(0, 8*kb, 0)
+	data := make([]byte, mb)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := readChunks(test, data, params)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		test.Fatalf("Chunks do not add up to the data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > params.Max || (len(chunk) < params.Min && i != len(chunks)-1) {
+			test.Errorf("Chunk %d of %d bytes is outside %d to %d", i, len(chunk), params.Min, params.Max)
+		}
+	}
+	// the average is the minimum plus the expected distance to a boundary
+	if n := len(chunks); n < mb/(params.Min+2*params.Avg) || n > mb/params.Min {
+		test.Errorf("Unexpected number of chunks %d for an average size of %d", n, params.Avg)
+	}
+
+	// inserting a byte only changes the chunks around it
+	shifted := append([]byte{42}, data...)
+	before := make(map[[sha256.Size]byte]bool)
+	for _, chunk := range chunks {
+		before[sha256.Sum256(chunk)] = true
+	}
+	shiftedChunks := readChunks(test, shifted, params)
+	same := 0
+	for _, chunk := range shiftedChunks {
+		if before[sha256.Sum256(chunk)] {
+			same++
+		}
+	}
+	if same < len(shiftedChunks)-2 {
+		test.Errorf("Expected all but the first chunks to be unchanged. %d of %d are", same, len(shiftedChunks))
+	}
+
+	if chunks := readChunks(test, nil, params); len(chunks) != 0 {
+		test.Errorf("Expected no chunks for empty data. Received %d", len(chunks))
+	}
+}
+
+func TestGetChunkHashes(test *testing.T) {
+	dataDir, hashDir, cleanup := tempDirs(test)
+	defer cleanup()
+
+	data := make([]byte, 2*mb)
+	rand.New(rand.NewSource(1)).Read(data)
+	fn := filepath.Join(dataDir, "collection-0-1.wt")
+
+	opts := BackupSizingOpts{
+		FalsePosRate:  0.01,
+		HashDir:       hashDir,
+		NumCPUs:       runtime.NumCPU(),
+		Offline:       true,
+		DbPath:        dataDir,
+		StorageEngine: wiredTiger,
+		Chunking:      NewChunkParams(0, 16*kb, 0),
+	}
+
+	// a few bytes inserted at the start shift every fixed size block
+	var blockStats *AllBlockSizeStats
+	var chunkStats *BlockStats
+	var err error
+	for iter, contents := range [][]byte{data, append([]byte("abc"), data...)} {
+		ioutil.WriteFile(fn, contents, 0666)
+		blockStats, err = GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb}, iter)
+		if err != nil {
+			test.Fatalf("Failed to hash blocks in %s. Err: %v", dataDir, err)
+		}
+		chunkStats, err = GetChunkHashes(context.Background(), &opts, dataDir, iter)
+		if err != nil {
+			test.Fatalf("Failed to hash chunks in %s. Err: %v", dataDir, err)
+		}
+	}
+
+	if rate := (*blockStats)[64*kb].DedupRate; rate > 0.1 {
+		test.Errorf("Expected shifted fixed size blocks not to dedup. Received %f", rate)
+	}
+	if chunkStats.DedupRate < 0.9 {
+		test.Errorf("Expected most chunks to dedup. Received %f", chunkStats.DedupRate)
+	}
+	if _, err := os.Stat(filepath.Join(hashDir, "cdc-16384", "1")); err != nil {
+		test.Errorf("Expected chunk hashes to be saved. Err: %v", err)
+	}
+}
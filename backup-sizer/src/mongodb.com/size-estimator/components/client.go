@@ -0,0 +1,168 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+)
+
+var OfflineError = errors.New("Not connected to a server when running offline")
+
+// Client runs the estimator's analyses with one session, which it opens in NewClient and closes in
+// Close, so it can be embedded in a long running program. It never exits the process, unlike
+// BackupSizingOpts.GetSession. An offline Client has no session and only analyzes the files in
+// DbPath. A Client is not safe to use from several goroutines.
+type Client struct {
+	opts          BackupSizingOpts
+	session       *mgo.Session
+	storageEngine StorageEngine
+	dbpath        string
+}
+
+// NewClient connects to the server described by opts, or checks DbPath when running offline.
+func NewClient(opts BackupSizingOpts) (*Client, error) {
+	c := &Client{opts: opts}
+	if opts.Offline {
+		if opts.DbPath == "" {
+			return nil, Permanent(fmt.Errorf("A dbpath is required when running offline"))
+		}
+		storageEngine, err := opts.GetStorageEngine()
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("Failed to determine the storage engine of %s. Err: %v", opts.DbPath,
+				err))
+		}
+		c.storageEngine = storageEngine
+		c.dbpath = opts.DbPath
+		return c, nil
+	}
+
+	session, err := opts.Connect()
+	if err != nil {
+		return nil, err
+	}
+	c.session = session
+
+	c.storageEngine = opts.StorageEngine
+	if c.storageEngine == "" && !opts.Cluster {
+		c.storageEngine, err = getStorageEngine(session)
+		if err != nil {
+			session.Close()
+			err = keepPermanent(err, fmt.Errorf("Failed to get storage engine for session on port %s. Err: %v",
+				opts.SafeUri(), err))
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) Close() {
+	if c.session != nil {
+		c.session.Close()
+	}
+}
+
+// Session is nil when running offline.
+func (c *Client) Session() *mgo.Session {
+	return c.session
+}
+
+// Refresh makes the next command pick a new connection, e.g. after the primary stepped down.
+func (c *Client) Refresh() {
+	if c.session != nil {
+		c.session.Refresh()
+	}
+}
+
+func (c *Client) StorageEngine() StorageEngine {
+	return c.storageEngine
+}
+
+// DbPath asks the server for its data directory the first time. With a Member, the directory must be
+// the member's own, on this host.
+func (c *Client) DbPath() (string, error) {
+	if c.dbpath != "" {
+		return c.dbpath, nil
+	}
+	if c.opts.Cluster {
+		return "", Permanent(fmt.Errorf("The files of a sharded cluster are not on this host"))
+	}
+
+	dbpath, err := GetDbPath(c.session)
+	if err != nil {
+		return "", err
+	}
+	if c.opts.Member != "" {
+		if err := VerifyLocalDbPath(c.session, dbpath); err != nil {
+			return "", keepPermanent(err, fmt.Errorf("Cannot analyze the %s member's files. Err: %v", c.opts.Member,
+				err))
+		}
+	}
+	c.dbpath = dbpath
+	return dbpath, nil
+}
+
+func (c *Client) OplogStats(ctx context.Context) (*OplogStats, error) {
+	if c.session == nil {
+		return nil, OfflineError
+	}
+	return GetOplogStats(ctx, c.session, c.opts.SleepTime, c.opts.OplogCompressor)
+}
+
+// SizeStats only has the size of the files in DbPath when running offline.
+func (c *Client) SizeStats(ctx context.Context) (*SizeStats, error) {
+	if c.session == nil {
+		return GetOfflineSizeStats(c.dbpath, c.storageEngine)
+	}
+	return GetSizeStats(ctx, c.session)
+}
+
+// ClusterStats needs a session with a mongos.
+func (c *Client) ClusterStats(ctx context.Context) (*ClusterStats, error) {
+	if c.session == nil {
+		return nil, OfflineError
+	}
+	return GetClusterStats(ctx, &c.opts, c.session, c.opts.SleepTime)
+}
+
+// BlockHashes analyzes the files in DbPath. See GetBlockHashes.
+func (c *Client) BlockHashes(ctx context.Context, blocksizes []int, iteration int) (*AllBlockSizeStats, error) {
+	dbpath, err := c.DbPath()
+	if err != nil {
+		return nil, err
+	}
+	return GetBlockHashes(ctx, c.fileOpts(), dbpath, blocksizes, iteration)
+}
+
+// ChunkHashes analyzes the files in DbPath with content defined chunking. See GetChunkHashes.
+func (c *Client) ChunkHashes(ctx context.Context, iteration int) (*BlockStats, error) {
+	dbpath, err := c.DbPath()
+	if err != nil {
+		return nil, err
+	}
+	return GetChunkHashes(ctx, c.fileOpts(), dbpath, iteration)
+}
+
+// IdentNamespaces is nil when running offline. See GetIdentNamespaces.
+func (c *Client) IdentNamespaces() (map[string]string, error) {
+	if c.session == nil {
+		return nil, nil
+	}
+	return GetIdentNamespaces(c.session)
+}
+
+// Breakdown breaks down stats returned by BlockHashes. idents may be nil, see NewBreakdown.
+func (c *Client) Breakdown(stats *AllBlockSizeStats, idents map[string]string) (*Breakdown, error) {
+	dbpath, err := c.DbPath()
+	if err != nil {
+		return nil, err
+	}
+	return NewBreakdown(stats, dbpath, c.storageEngine, idents)
+}
+
+// fileOpts knows the storage engine, so the file analyses don't ask the server for it again.
+func (c *Client) fileOpts() *BackupSizingOpts {
+	opts := c.opts
+	opts.StorageEngine = c.storageEngine
+	return &opts
+}
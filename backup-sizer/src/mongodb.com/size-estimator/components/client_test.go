@@ -0,0 +1,60 @@
+package components
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestOfflineClient(test *testing.T) {
+	if _, err := NewClient(BackupSizingOpts{Offline: true}); err == nil {
+		test.Errorf("Expected error without a dbpath")
+	}
+
+	dataDir, hashDir, cleanup := tempDirs(test)
+	defer cleanup()
+	ioutil.WriteFile(filepath.Join(dataDir, "WiredTiger"), []byte("WiredTiger\n"), 0666)
+	ioutil.WriteFile(filepath.Join(dataDir, "collection-0-1.wt"), make([]byte, mb), 0666)
+
+	client, err := NewClient(BackupSizingOpts{
+		Offline:      true,
+		DbPath:       dataDir,
+		HashDir:      hashDir,
+		FalsePosRate: 0.01,
+		Breakdown:    true,
+	})
+	if err != nil {
+		test.Fatalf("Failed to create offline client. Err: %v", err)
+	}
+	defer client.Close()
+
+	if client.Session() != nil || client.StorageEngine() != wiredTiger {
+		test.Errorf("Expected a wiredTiger client without a session. Received %s", client.StorageEngine())
+	}
+	ctx := context.Background()
+	if _, err := client.OplogStats(ctx); err != OfflineError {
+		test.Errorf("Expected %v. Received %v", OfflineError, err)
+	}
+	sizeStats, err := client.SizeStats(ctx)
+	if err != nil || sizeStats.FileSize < mb {
+		test.Errorf("Expected at least %d bytes of files. Received %+v, err: %v", mb, sizeStats, err)
+	}
+
+	blockStats, err := client.BlockHashes(ctx, []int{64 * kb}, 0)
+	if err != nil {
+		test.Fatalf("Failed to hash %s. Err: %v", dataDir, err)
+	}
+	if n := (*blockStats)[64*kb].TotalHashes; n < 16 {
+		test.Errorf("Expected at least 16 blocks. Received %d", n)
+	}
+
+	idents, err := client.IdentNamespaces()
+	if idents != nil || err != nil {
+		test.Errorf("Expected no idents offline. Received %v, err: %v", idents, err)
+	}
+	breakdown, err := client.Breakdown(blockStats, nil)
+	if err != nil || len(breakdown.Files) == 0 {
+		test.Errorf("Expected a breakdown by file. Received %+v, err: %v", breakdown, err)
+	}
+}
@@ -0,0 +1,186 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"strings"
+	"time"
+)
+
+const configShardId = "config"
+
+type Shard struct {
+	Id   string `bson:"_id"`
+	Host string `bson:"host"`
+}
+
+type ShardStats struct {
+	Shard      string
+	Host       string
+	OplogStats *OplogStats
+	SizeStats  *SizeStats
+}
+
+// ClusterStats holds the stats of every shard and the config servers, and their sum.
+type ClusterStats struct {
+	Shards     []*ShardStats
+	OplogStats *OplogStats
+	SizeStats  *SizeStats
+}
+
+func IsMongos(session *mgo.Session) (bool, error) {
+	var result struct {
+		Msg string `bson:"msg"`
+	}
+	if err := session.DB("admin").Run(bson.D{{"isMaster", 1}}, &result); err != nil {
+		return false, err
+	}
+	return result.Msg == "isdbgrid", nil
+}
+
+func GetShards(session *mgo.Session) ([]Shard, error) {
+	shards := make([]Shard, 0)
+	if err := session.DB("config").C("shards").Find(nil).Sort("_id").All(&shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// GetConfigServers returns the config server connection string, in the same "set/host,host" form
+// as a shard host.
+func GetConfigServers(session *mgo.Session) (string, error) {
+	var result struct {
+		Map map[string]string `bson:"map"`
+	}
+	if err := session.DB("admin").Run(bson.D{{"getShardMap", 1}}, &result); err != nil {
+		return "", err
+	}
+	host, ok := result.Map[configShardId]
+	if !ok {
+		return "", fmt.Errorf("getShardMap did not return the config servers")
+	}
+	return host, nil
+}
+
+// ParseShardHost splits "rs0/a:27017,b:27017" into the replica set name and its members. Shards that
+// are not replica sets have no set name.
+func ParseShardHost(host string) (string, []string) {
+	setName := ""
+	if slash := strings.Index(host, "/"); slash >= 0 {
+		setName = host[:slash]
+		host = host[slash+1:]
+	}
+	return setName, strings.Split(host, ",")
+}
+
+// SessionFor dials a shard with the same credentials and TLS options used for the mongos.
+func (opts BackupSizingOpts) SessionFor(host string) (*mgo.Session, error) {
+	info, err := opts.DialInfo()
+	if err != nil {
+		return nil, err
+	}
+	info.ReplicaSetName, info.Addrs = ParseShardHost(host)
+	info.Direct = false
+	return mgo.DialWithInfo(info)
+}
+
+func GetClusterStats(ctx context.Context, opts *BackupSizingOpts, mongos *mgo.Session,
+	timeInterval time.Duration) (*ClusterStats, error) {
+
+	shards, err := GetShards(mongos)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config.shards. Err: %v", err)
+	}
+	configHost, err := GetConfigServers(mongos)
+	if err != nil {
+		return nil, err
+	}
+	shards = append(shards, Shard{configShardId, configHost})
+
+	cluster := &ClusterStats{Shards: make([]*ShardStats, 0, len(shards))}
+	for _, shard := range shards {
+		stats, err := getShardStats(ctx, opts, shard, timeInterval)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get stats for shard %s (%s). Err: %v", shard.Id, shard.Host, err)
+		}
+		cluster.Shards = append(cluster.Shards, stats)
+	}
+
+	oplogStats := make([]*OplogStats, 0, len(cluster.Shards))
+	sizeStats := make([]*SizeStats, 0, len(cluster.Shards))
+	for _, stats := range cluster.Shards {
+		if stats.OplogStats != nil {
+			oplogStats = append(oplogStats, stats.OplogStats)
+		}
+		sizeStats = append(sizeStats, stats.SizeStats)
+	}
+	cluster.OplogStats = AggregateOplogStats(oplogStats)
+	cluster.SizeStats = AggregateSizeStats(sizeStats)
+	return cluster, nil
+}
+
+func getShardStats(ctx context.Context, opts *BackupSizingOpts, shard Shard, timeInterval time.Duration) (
+	*ShardStats, error) {
+	session, err := opts.SessionFor(shard.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	stats := &ShardStats{Shard: shard.Id, Host: shard.Host}
+
+	stats.OplogStats, err = GetOplogStats(ctx, session, timeInterval, opts.OplogCompressor)
+	// mirrored (SCCC) config servers are not a replica set and have no oplog
+	if err == OplogNotFoundError && shard.Id == configShardId {
+		stats.OplogStats, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the shard's dbpath is on its own host
+	stats.SizeStats, err = GetRemoteSizeStats(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// AggregateOplogStats sums the oplog of every shard. The compression ratio is weighted by each
+// shard's oplog volume, and the window covers the earliest start to the latest end. Shards with no
+// oplog entries in the interval have no ratio and are counted uncompressed.
+func AggregateOplogStats(stats []*OplogStats) *OplogStats {
+	total := &OplogStats{}
+	compressibleGb := 0.0
+	compressedGb := 0.0
+	for i, s := range stats {
+		if i == 0 || s.StartTS < total.StartTS {
+			total.StartTS = s.StartTS
+		}
+		if s.EndTS > total.EndTS {
+			total.EndTS = s.EndTS
+		}
+		total.Size += s.Size
+		total.GbPerDay += s.GbPerDay
+		if !math.IsNaN(s.CompressedGbPerDay) && !math.IsInf(s.CompressedGbPerDay, 0) {
+			compressibleGb += s.GbPerDay
+			compressedGb += s.CompressedGbPerDay
+		}
+	}
+	total.CompressionRatio = compressibleGb / compressedGb
+	total.CompressedGbPerDay = compressedGb + (total.GbPerDay - compressibleGb)
+	return total
+}
+
+func AggregateSizeStats(stats []*SizeStats) *SizeStats {
+	total := &SizeStats{}
+	for _, s := range stats {
+		total.DataSize += s.DataSize
+		total.IndexSize += s.IndexSize
+		total.FileSize += s.FileSize
+	}
+	return total
+}
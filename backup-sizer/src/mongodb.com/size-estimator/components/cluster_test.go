@@ -0,0 +1,53 @@
+package components
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseShardHost(test *testing.T) {
+	testCases := []struct {
+		host    string
+		setName string
+		addrs   []string
+	}{
+		{"rs0/a:27017,b:27018", "rs0", []string{"a:27017", "b:27018"}},
+		{"configRS/cfg:27019", "configRS", []string{"cfg:27019"}},
+		{"a:27017", "", []string{"a:27017"}},
+		{"cfg1:27019,cfg2:27019,cfg3:27019", "", []string{"cfg1:27019", "cfg2:27019", "cfg3:27019"}},
+	}
+	for _, testCase := range testCases {
+		setName, addrs := ParseShardHost(testCase.host)
+		if setName != testCase.setName || !reflect.DeepEqual(addrs, testCase.addrs) {
+			test.Errorf("Expected (%s, %v) for %s. Received (%s, %v)", testCase.setName, testCase.addrs,
+				testCase.host, setName, addrs)
+		}
+	}
+}
+
+func TestAggregateStats(test *testing.T) {
+	oplogStats := []*OplogStats{
+		{StartTS: 10, EndTS: 20, Size: 100, GbPerDay: 4, CompressionRatio: 4, CompressedGbPerDay: 1},
+		{StartTS: 5, EndTS: 15, Size: 50, GbPerDay: 2, CompressionRatio: 2, CompressedGbPerDay: 1},
+		// no oplog entries in the interval, so no compression ratio
+		{StartTS: 8, EndTS: 30, Size: 10, GbPerDay: 1, CompressionRatio: math.NaN(),
+			CompressedGbPerDay: math.NaN()},
+	}
+	total := AggregateOplogStats(oplogStats)
+	if total.StartTS != 5 || total.EndTS != 30 || total.Size != 160 || total.GbPerDay != 7 {
+		test.Errorf("Unexpected aggregate oplog stats %+v", total)
+	}
+	if total.CompressionRatio != 3 || total.CompressedGbPerDay != 3 {
+		test.Errorf("Expected compression ratio 3 and 3 compressed GB per day. Received %f and %f",
+			total.CompressionRatio, total.CompressedGbPerDay)
+	}
+
+	sizeStats := AggregateSizeStats([]*SizeStats{
+		{DataSize: 1, IndexSize: 2, FileSize: 3},
+		{DataSize: 10, IndexSize: 20, FileSize: 30},
+	})
+	if *sizeStats != (SizeStats{11, 22, 33}) {
+		test.Errorf("Unexpected aggregate size stats %+v", sizeStats)
+	}
+}
@@ -1,12 +1,15 @@
 package components
 
 import (
+	"crypto/tls"
 	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -17,81 +20,296 @@ const (
 	mmap       StorageEngine = "mmapv1"
 )
 
+func ParseStorageEngine(name string) (StorageEngine, error) {
+	switch strings.ToLower(name) {
+	case strings.ToLower(string(wiredTiger)):
+		return wiredTiger, nil
+	case string(mmap), "mmap":
+		return mmap, nil
+	}
+	return "", fmt.Errorf("Unknown storage engine %s. Expected %s or %s", name, wiredTiger, mmap)
+}
+
+const (
+	AuthScramSha1 = "SCRAM-SHA-1"
+	AuthMongoCR   = "MONGODB-CR"
+	AuthX509      = "MONGODB-X509"
+
+	defaultDialTimeout = 10 * time.Second
+)
+
 type BackupSizingOpts struct {
-	Host         string
-	Port         int
-	SleepTime    time.Duration
-	NumIter      int
-	Uri          string
+	Host          string
+	Port          int
+	SleepTime     time.Duration
+	NumIter       int
+	Uri           string // host:port or a mongodb:// connection string
+	Username      string
+	Password      string
+	AuthDB        string
+	AuthMechanism string
+
+	DialTimeout   time.Duration // 10s if not set
+	SocketTimeout time.Duration // mgo's default of 1 minute if not set
+	PoolLimit     int           // sockets per server, mgo's default of 4096 if not set
+
+	SSL                         bool
+	SSLCAFile                   string
+	SSLPEMKeyFile               string // client certificate and key
+	SSLAllowInvalidHostnames    bool
+	SSLAllowInvalidCertificates bool
+
+	Cluster bool   // connected to a mongos
+	Member  string // replica set member to analyze: primary, secondary, hidden or host:port
+
+	// Offline runs analyze DbPath directly without contacting a server
+	Offline       bool
+	DbPath        string
+	StorageEngine StorageEngine
+
 	HashDir      string
+	DigestSize   int // bytes of each SHA-256 digest kept in the hash files
 	FalsePosRate float64
+	DedupMode    DedupMode
+	DedupWindow  int // previous iterations a block is deduplicated against, 0 for all of them
+
+	BlockCompressors []Compressor // the first one decides DataCompressionRatio
+	OplogCompressor  Compressor
+	Chunking         ChunkParams // content defined chunking, measured alongside the fixed block sizes
+	Breakdown        bool        // track the smallest block size by file, see NewBreakdown
+
 	NumCPUs      int
+	NumSplitters int     // goroutines reading files, 3 if not set
+	NumHashers   int     // goroutines hashing and compressing blocks, NumCPUs if not set
+	MaxReadMBps  float64 // cap on the rate files are read at, unlimited if not set
+
+	// called periodically while GetBlockHashes reads the dbpath
+	ProgressFunc     ProgressFunc
+	ProgressInterval time.Duration // DefaultProgressInterval if not set
+
+	// server commands are retried with Retry, and a run gives up after MaxConsecutiveFailures iterations
+	// in a row are missing a component
+	Retry                  RetryPolicy
+	MaxConsecutiveFailures int
+
+	Output   string
+	Resume   bool
+	Schedule SnapshotSchedule
 }
 
+// GetSession exits if it cannot connect. Programs embedding the estimator should use Connect or a
+// Client instead.
 func (opts BackupSizingOpts) GetSession() *mgo.Session {
-	session, err := mgo.Dial(opts.Uri)
+	session, err := opts.Connect()
 	if err != nil {
-		fmt.Printf("Failed to dial MongoDB on port %v. Err %v\n", opts.Uri, err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 	return session
 }
 
+// Connect dials the server, or the chosen Member of its replica set.
+func (opts BackupSizingOpts) Connect() (*mgo.Session, error) {
+	if opts.Member != "" {
+		session, err := opts.MemberSession()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to %s member of %v. Err %v", opts.Member, opts.SafeUri(), err)
+		}
+		if opts.SocketTimeout > 0 {
+			session.SetSocketTimeout(opts.SocketTimeout)
+		}
+		return session, nil
+	}
+
+	info, err := opts.DialInfo()
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("Invalid connection options for %v. Err %v", opts.SafeUri(), err))
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to dial MongoDB on port %v. Err %v", opts.SafeUri(), err)
+	}
+	if opts.SocketTimeout > 0 {
+		session.SetSocketTimeout(opts.SocketTimeout)
+	}
+	return session, nil
+}
+
+// DialInfo parses Uri and applies the explicit authentication and TLS options on top of it.
+func (opts BackupSizingOpts) DialInfo() (*mgo.DialInfo, error) {
+	uri, uriTLS, err := removeTLSOptions(opts.Uri)
+	if err != nil {
+		return nil, err
+	}
+	info, err := mgo.ParseURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = defaultDialTimeout
+	if opts.DialTimeout > 0 {
+		info.Timeout = opts.DialTimeout
+	}
+	if opts.PoolLimit > 0 {
+		info.PoolLimit = opts.PoolLimit
+	}
+
+	var config *tls.Config
+	if uriTLS || opts.TLSEnabled() {
+		config, err = opts.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		timeout := info.Timeout
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return dialTLS(addr.String(), config, timeout)
+		}
+	}
+
+	if opts.Username != "" {
+		info.Username = opts.Username
+	}
+	if opts.Password != "" {
+		info.Password = opts.Password
+	}
+	if opts.AuthDB != "" {
+		info.Source = opts.AuthDB
+	}
+	if opts.AuthMechanism != "" {
+		info.Mechanism = opts.AuthMechanism
+	}
+
+	switch strings.ToUpper(info.Mechanism) {
+	case "":
+	case AuthScramSha1, AuthMongoCR:
+		info.Mechanism = strings.ToUpper(info.Mechanism)
+		if info.Username == "" {
+			return nil, fmt.Errorf("Authentication mechanism %s requires a username", info.Mechanism)
+		}
+	case AuthX509, "X509", "X.509":
+		info.Mechanism = AuthX509
+		if info.Source == "" {
+			info.Source = "$external"
+		}
+		if info.Source != "$external" {
+			return nil, fmt.Errorf("Authentication mechanism %s requires the $external database. Received %s",
+				AuthX509, info.Source)
+		}
+		if config == nil {
+			return nil, fmt.Errorf("Authentication mechanism %s requires TLS", AuthX509)
+		}
+		if info.Username == "" {
+			info.Username, err = x509Username(config)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported authentication mechanism %s. Expected one of %s, %s, %s",
+			info.Mechanism, AuthScramSha1, AuthMongoCR, AuthX509)
+	}
+	return info, nil
+}
+
+// SafeUri is Uri without the password, for messages and saved state.
+func (opts BackupSizingOpts) SafeUri() string {
+	const scheme = "mongodb://"
+	if !strings.HasPrefix(opts.Uri, scheme) {
+		return opts.Uri
+	}
+	rest := opts.Uri[len(scheme):]
+	hostsEnd := strings.Index(rest, "/")
+	if hostsEnd < 0 {
+		hostsEnd = len(rest)
+	}
+	at := strings.LastIndex(rest[:hostsEnd], "@")
+	if at < 0 {
+		return opts.Uri
+	}
+	user := rest[:at]
+	if colon := strings.Index(user, ":"); colon >= 0 {
+		user = user[:colon]
+	}
+	return scheme + user + "@" + rest[at+1:]
+}
+
 func (opts BackupSizingOpts) GetDBPath() (string, error) {
-	session := opts.GetSession()
+	if opts.Offline {
+		if opts.DbPath == "" {
+			return "", fmt.Errorf("A dbpath is required when running offline")
+		}
+		return opts.DbPath, nil
+	}
+	session, err := opts.Connect()
+	if err != nil {
+		return "", err
+	}
 	defer session.Close()
 
 	return GetDbPath(session)
 }
 
+// GetStorageEngine asks the server unless running offline, in which case the files in DbPath must
+// agree with StorageEngine, or decide it if it isn't set. A set StorageEngine is only trusted when no
+// engine's files are found at all.
 func (opts BackupSizingOpts) GetStorageEngine() (StorageEngine, error) {
-	session := opts.GetSession()
+	if opts.Offline {
+		detected, err := DetectStorageEngine(opts.DbPath)
+		if opts.StorageEngine == "" {
+			return detected, err
+		}
+		if err == UnknownStorageLayoutError {
+			return opts.StorageEngine, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("Failed to check the files in %s against storage engine %s. Err: %v",
+				opts.DbPath, opts.StorageEngine, err)
+		}
+		if detected != opts.StorageEngine {
+			return "", fmt.Errorf("Storage engine %s does not match the %s files in %s", opts.StorageEngine,
+				detected, opts.DbPath)
+		}
+		return opts.StorageEngine, nil
+	}
+	if opts.StorageEngine != "" {
+		return opts.StorageEngine, nil
+	}
+	session, err := opts.Connect()
+	if err != nil {
+		return "", err
+	}
 	defer session.Close()
 
 	return getStorageEngine(session)
 }
 
 func getStorageEngine(session *mgo.Session) (StorageEngine, error) {
-	var result bson.M
-	err := serverStatus(session, &result)
+	version, err := getMongodVersion(session)
 	if err != nil {
 		return "", err
 	}
-
-	storageEngine := result["storageEngine"].(bson.M)
-	se := StorageEngine(storageEngine["name"].(string))
-	return se, nil
+	var result serverStatusResult
+	if err := serverStatus(session, &result); err != nil {
+		return "", err
+	}
+	return result.storageEngine(version)
 }
 
 func GetDbPath(session *mgo.Session) (string, error) {
-	var results (bson.M)
-	session.DB("admin").Run(bson.D{{"getCmdLineOpts", 1}}, &results)
+	var result cmdLineOptsResult
+	if err := session.DB("admin").Run(bson.D{{"getCmdLineOpts", 1}}, &result); err != nil {
+		return "", fmt.Errorf("Failed to run getCmdLineOpts. Err: %v", err)
+	}
 
-	parsed := results["parsed"].(bson.M)
-	v, err := getMongodVersion(session)
+	version, err := getMongodVersion(session)
 	if err != nil {
 		return "", err
 	}
-
-	var dbpath string = "/data/db" // mongodb default
-	switch v[0:3] {
-	case "2.6":
-		if parsed["dbpath"] != nil {
-			dbpath = parsed["dbpath"].(string)
-		}
-	default:
-		storage := parsed["storage"].(bson.M)
-		if storage["dbPath"] != nil {
-			dbpath = storage["dbPath"].(string)
-		}
-	}
-
-	return dbpath, err
+	return result.dbPath(version)
 }
 
-func serverStatus(session *mgo.Session, result *bson.M) error {
+func serverStatus(session *mgo.Session, result interface{}) error {
 	if err := session.DB("admin").Run(bson.D{{"serverStatus", 1}, {"oplog", 1}}, result); err != nil {
-		return err
+		return fmt.Errorf("Failed to run serverStatus. Err: %v", err)
 	}
 	return nil
 }
@@ -140,7 +358,7 @@ func getFilesInDir(dir string, storageEngine StorageEngine, crawlFurther bool) (
 	f, err := os.Open(dir)
 	if err != nil {
 		if os.IsPermission(err) {
-			fmt.Printf("Incorrect permissions for file %s\n", dir)
+			fmt.Fprintf(os.Stderr, "Incorrect permissions for file %s\n", dir)
 		}
 		return nil, err
 	}
@@ -159,6 +377,8 @@ func getFilesInDir(dir string, storageEngine StorageEngine, crawlFurther bool) (
 		excludeRegexes = []string{"mongod.lock", "WiredTiger.basecfg", "mongodb.log", "journal"}
 	case mmap:
 		excludeRegexes = []string{"mongod.lock", "local.*", "mongodb.log", "journal"}
+	default:
+		return nil, fmt.Errorf("Unknown storage engine %q for %s", storageEngine, dir)
 	}
 
 	for _, fi := range fileInfos {
@@ -2,7 +2,9 @@ package components
 
 import (
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetStorageEngine(test *testing.T) {
@@ -35,6 +37,19 @@ func TestGetStorageEngine(test *testing.T) {
 
 }
 
+func TestParseStorageEngine(test *testing.T) {
+	for name, expected := range map[string]StorageEngine{"wiredTiger": wiredTiger, "wiredtiger": wiredTiger,
+		"mmapv1": mmap, "mmap": mmap} {
+		se, err := ParseStorageEngine(name)
+		if err != nil || se != expected {
+			test.Errorf("Expected %s for %s. Received %s, err: %v", expected, name, se, err)
+		}
+	}
+	if _, err := ParseStorageEngine("inMemory"); err == nil {
+		test.Errorf("Expected error for unknown storage engine")
+	}
+}
+
 func TestGetFilesInDir(test *testing.T) {
 	files, err := getFilesInDir(TestDataDir, mmap, true)
 	if err != nil {
@@ -50,3 +65,72 @@ func TestGetFilesInDir(test *testing.T) {
 		}
 	}
 }
+
+func TestDialInfo(test *testing.T) {
+	opts := BackupSizingOpts{Uri: "localhost:27017"}
+	info, err := opts.DialInfo()
+	if err != nil {
+		test.Fatalf("Failed to parse %s. Err: %v", opts.Uri, err)
+	}
+	if len(info.Addrs) != 1 || info.Addrs[0] != "localhost:27017" || info.Username != "" {
+		test.Errorf("Unexpected dial info for %s: %+v", opts.Uri, info)
+	}
+	if info.Timeout != defaultDialTimeout || info.PoolLimit != 0 {
+		test.Errorf("Expected the default timeout and pool limit. Received %v, %d", info.Timeout, info.PoolLimit)
+	}
+	opts.DialTimeout = time.Second
+	opts.PoolLimit = 8
+	info, err = opts.DialInfo()
+	if err != nil || info.Timeout != time.Second || info.PoolLimit != 8 {
+		test.Errorf("Expected timeout %v and pool limit 8. Received %+v, err: %v", time.Second, info, err)
+	}
+
+	opts = BackupSizingOpts{Uri: "mongodb://user:secret@a:1,b:2/?authSource=admin&authMechanism=SCRAM-SHA-1"}
+	info, err = opts.DialInfo()
+	if err != nil {
+		test.Fatalf("Failed to parse %s. Err: %v", opts.Uri, err)
+	}
+	if len(info.Addrs) != 2 || info.Username != "user" || info.Password != "secret" || info.Source != "admin" ||
+		info.Mechanism != AuthScramSha1 {
+		test.Errorf("Unexpected dial info for %s: %+v", opts.Uri, info)
+	}
+	if safe := opts.SafeUri(); strings.Contains(safe, "secret") {
+		test.Errorf("Password was not removed from %s", safe)
+	}
+
+	// explicit options override the connection string
+	opts.Username = "other"
+	opts.Password = "pass"
+	opts.AuthDB = "users"
+	opts.AuthMechanism = "mongodb-cr"
+	info, err = opts.DialInfo()
+	if err != nil {
+		test.Fatalf("Failed to parse %s. Err: %v", opts.Uri, err)
+	}
+	if info.Username != "other" || info.Password != "pass" || info.Source != "users" ||
+		info.Mechanism != AuthMongoCR {
+		test.Errorf("Explicit options were not applied: %+v", info)
+	}
+
+	opts = BackupSizingOpts{Uri: "localhost", Username: "CN=client", AuthMechanism: "x.509", SSL: true}
+	info, err = opts.DialInfo()
+	if err != nil {
+		test.Fatalf("Failed to parse x.509 options. Err: %v", err)
+	}
+	if info.Mechanism != AuthX509 || info.Source != "$external" {
+		test.Errorf("Unexpected dial info for x.509: %+v", info)
+	}
+
+	badOpts := []BackupSizingOpts{
+		{Uri: "localhost", AuthMechanism: "PLAIN", Username: "user"},
+		{Uri: "localhost", AuthMechanism: AuthScramSha1},
+		{Uri: "localhost", AuthMechanism: AuthX509, AuthDB: "admin", SSL: true},
+		{Uri: "localhost", AuthMechanism: AuthX509, Username: "CN=client"},
+		{Uri: "mongodb://localhost/?unknownOption=1"},
+	}
+	for _, opts := range badOpts {
+		if _, err := opts.DialInfo(); err == nil {
+			test.Errorf("Expected error for options %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package components
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+)
+
+// number is a numeric field of a command response. Depending on the server version and the size of the
+// value, the server sends int32, int64, double or decimal, so any of them is accepted.
+type number struct {
+	value    float64
+	set      bool
+	received string // the type of a value that is not a number
+}
+
+func (n *number) SetBSON(raw bson.Raw) error {
+	var v interface{}
+	if err := raw.Unmarshal(&v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		n.value = v
+	case int:
+		n.value = float64(v)
+	case int64:
+		n.value = float64(v)
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			n.received = fmt.Sprintf("decimal %s", v)
+			return nil
+		}
+		n.value = f
+	default:
+		n.received = fmt.Sprintf("%T", v)
+		return nil
+	}
+	n.set = true
+	return nil
+}
+
+func (n number) missing() bool {
+	return !n.set && n.received == ""
+}
+
+// get returns the value of the field of cmd's response, or an error naming both if it is missing or not
+// a number.
+func (n number) get(cmd, field string) (float64, error) {
+	if n.received != "" {
+		return 0, fmt.Errorf("Expected %s to return a number for %s. Received %s", cmd, field, n.received)
+	}
+	if !n.set {
+		return 0, missingField(cmd, field)
+	}
+	return n.value, nil
+}
+
+func missingField(cmd, field string) error {
+	return fmt.Errorf("Expected %s to return %s", cmd, field)
+}
+
+type serverStatusResult struct {
+	StorageEngine struct {
+		Name string `bson:"name"`
+	} `bson:"storageEngine"`
+	Oplog struct {
+		EarliestOptime bson.MongoTimestamp `bson:"earliestOptime"`
+		LatestOptime   bson.MongoTimestamp `bson:"latestOptime"`
+	} `bson:"oplog"`
+}
+
+// storageEngine is mmapv1 on servers before 3.0, which don't report one.
+func (r *serverStatusResult) storageEngine(version ServerVersion) (StorageEngine, error) {
+	if r.StorageEngine.Name == "" {
+		if !version.AtLeast(3, 0) {
+			return mmap, nil
+		}
+		return "", missingField("serverStatus", "storageEngine.name")
+	}
+	return StorageEngine(r.StorageEngine.Name), nil
+}
+
+func (r *serverStatusResult) oplogTimes() (first, last bson.MongoTimestamp, err error) {
+	if r.Oplog.EarliestOptime == 0 {
+		return 0, 0, missingField("serverStatus", "oplog.earliestOptime")
+	}
+	if r.Oplog.LatestOptime == 0 {
+		return 0, 0, missingField("serverStatus", "oplog.latestOptime")
+	}
+	return r.Oplog.EarliestOptime, r.Oplog.LatestOptime, nil
+}
+
+type buildInfoResult struct {
+	Version string `bson:"version"`
+}
+
+func (r *buildInfoResult) version() (ServerVersion, error) {
+	if r.Version == "" {
+		return ServerVersion{}, missingField("buildInfo", "version")
+	}
+	v, err := ParseServerVersion(r.Version)
+	return v, Permanent(err)
+}
+
+type cmdLineOptsResult struct {
+	Parsed *struct {
+		DbPath  string `bson:"dbpath"`
+		Storage struct {
+			DbPath string `bson:"dbPath"`
+		} `bson:"storage"`
+	} `bson:"parsed"`
+}
+
+// dbPath is "/data/db", mongod's default, if the server was started without a dbpath. Servers before 3.0
+// report a dbpath from the command line or an old style config file at the top level, and only a YAML
+// config file's under storage.
+func (r *cmdLineOptsResult) dbPath(version ServerVersion) (string, error) {
+	if r.Parsed == nil {
+		return "", missingField("getCmdLineOpts", "parsed")
+	}
+	dbpath := r.Parsed.Storage.DbPath
+	if !version.AtLeast(3, 0) && r.Parsed.DbPath != "" {
+		dbpath = r.Parsed.DbPath
+	}
+	if dbpath == "" {
+		return "/data/db", nil
+	}
+	return dbpath, nil
+}
+
+type oplogEntryTime struct {
+	Ts bson.MongoTimestamp `bson:"ts"`
+}
+
+type oplogCollStatsResult struct {
+	Capped  *bool  `bson:"capped"`
+	MaxSize number `bson:"maxSize"`
+	Size    number `bson:"size"`
+}
+
+// size is the configured maximum size of the oplog, or its size if the server doesn't report a maximum.
+func (r *oplogCollStatsResult) size() (int, error) {
+	if r.Capped != nil && !*r.Capped {
+		return -1, Permanent(fmt.Errorf("Oplog is not capped"))
+	}
+	field, size := "maxSize", r.MaxSize
+	if size.missing() {
+		field, size = "size", r.Size
+	}
+	v, err := size.get("collStats", field)
+	if err != nil {
+		return -1, err
+	}
+	return int(v), nil
+}
+
+type dbStatsResult struct {
+	DataSize    number `bson:"dataSize"`
+	IndexSize   number `bson:"indexSize"`
+	StorageSize number `bson:"storageSize"`
+	FileSize    number `bson:"fileSize"` // mmapv1 only
+}
+
+// addTo adds the database's sizes to stats, and reports whether the server knew its file size.
+func (r *dbStatsResult) addTo(stats *SizeStats) (hasFileSize bool, err error) {
+	dataSize, err := r.DataSize.get("dbStats", "dataSize")
+	if err != nil {
+		return false, err
+	}
+	indexSize, err := r.IndexSize.get("dbStats", "indexSize")
+	if err != nil {
+		return false, err
+	}
+	stats.DataSize += dataSize
+	stats.IndexSize += indexSize
+
+	if r.FileSize.missing() {
+		return false, nil
+	}
+	fileSize, err := r.FileSize.get("dbStats", "fileSize")
+	if err != nil {
+		return false, err
+	}
+	stats.FileSize += fileSize
+	return true, nil
+}
+
+// storedSize is the space the database's collections and indexes take on disk, as far as the server
+// knows without reading its files.
+func (r *dbStatsResult) storedSize() (float64, error) {
+	storageSize, err := r.StorageSize.get("dbStats", "storageSize")
+	if err != nil {
+		return 0, err
+	}
+	indexSize, err := r.IndexSize.get("dbStats", "indexSize")
+	if err != nil {
+		return 0, err
+	}
+	return storageSize + indexSize, nil
+}
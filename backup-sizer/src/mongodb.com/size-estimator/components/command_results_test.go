@@ -0,0 +1,182 @@
+package components
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"testing"
+)
+
+// decodeResponse round trips a canned server response through bson, like session.Run does.
+func decodeResponse(test *testing.T, response bson.M, result interface{}) {
+	data, err := bson.Marshal(response)
+	if err != nil {
+		test.Fatalf("Failed to marshal %v. Err: %v", response, err)
+	}
+	if err := bson.Unmarshal(data, result); err != nil {
+		test.Fatalf("Failed to unmarshal %v. Err: %v", response, err)
+	}
+}
+
+func TestDbStatsResult(test *testing.T) {
+	decimal, _ := bson.ParseDecimal128("1024")
+	stats := &SizeStats{}
+	// wiredTiger, with sizes of each numeric type
+	for _, response := range []bson.M{
+		{"ok": 1.0, "dataSize": int32(1024), "indexSize": int64(2048)},
+		{"ok": 1.0, "dataSize": 1024.0, "indexSize": decimal},
+	} {
+		var result dbStatsResult
+		decodeResponse(test, response, &result)
+		hasFileSize, err := result.addTo(stats)
+		if err != nil || hasFileSize {
+			test.Errorf("Expected sizes without a file size from %v. Received %v, err: %v", response, hasFileSize,
+				err)
+		}
+	}
+	if stats.DataSize != 2048 || stats.IndexSize != 3072 || stats.FileSize != 0 {
+		test.Errorf("Expected data size 2048 and index size 3072. Received %+v", stats)
+	}
+
+	var mmap dbStatsResult
+	decodeResponse(test, bson.M{"dataSize": 1, "indexSize": 2, "fileSize": int64(1 << 40)}, &mmap)
+	if hasFileSize, err := mmap.addTo(stats); err != nil || !hasFileSize || stats.FileSize != 1<<40 {
+		test.Errorf("Expected file size %d. Received %+v, err: %v", 1<<40, stats, err)
+	}
+
+	for field, response := range map[string]bson.M{
+		"indexSize": {"dataSize": 1},
+		"dataSize":  {"dataSize": "1", "indexSize": 2},
+		"fileSize":  {"dataSize": 1, "indexSize": 2, "fileSize": bson.M{}},
+	} {
+		var result dbStatsResult
+		decodeResponse(test, response, &result)
+		_, err := result.addTo(&SizeStats{})
+		if err == nil || !strings.Contains(err.Error(), "dbStats") || !strings.Contains(err.Error(), field) {
+			test.Errorf("Expected an error naming dbStats and %s for %v. Received %v", field, response, err)
+		}
+	}
+}
+
+func TestOplogCollStatsResult(test *testing.T) {
+	for expected, response := range map[int]bson.M{
+		// a 2.6 oplog only has its size
+		1 << 20:  {"capped": true, "size": int32(1 << 20)},
+		5 << 30:  {"capped": true, "size": 100, "maxSize": int64(5 << 30)},
+		10 << 20: {"capped": true, "maxSize": float64(10 << 20)},
+	} {
+		var result oplogCollStatsResult
+		decodeResponse(test, response, &result)
+		if size, err := result.size(); err != nil || size != expected {
+			test.Errorf("Expected oplog size %d from %v. Received %d, err: %v", expected, response, size, err)
+		}
+	}
+
+	var uncapped oplogCollStatsResult
+	decodeResponse(test, bson.M{"capped": false, "size": 1}, &uncapped)
+	if _, err := uncapped.size(); err == nil {
+		test.Errorf("Expected error for an uncapped oplog")
+	}
+	var noSize oplogCollStatsResult
+	decodeResponse(test, bson.M{"capped": true}, &noSize)
+	if _, err := noSize.size(); err == nil || !strings.Contains(err.Error(), "size") {
+		test.Errorf("Expected error naming size. Received %v", err)
+	}
+}
+
+func TestServerStatusResult(test *testing.T) {
+	v30 := ServerVersion{3, 0, 15}
+	v44 := ServerVersion{4, 4, 6}
+	var result serverStatusResult
+	decodeResponse(test, bson.M{
+		"storageEngine": bson.M{"name": "wiredTiger"},
+		"oplog": bson.M{
+			"earliestOptime": bson.MongoTimestamp(1 << 32),
+			"latestOptime":   bson.MongoTimestamp(2 << 32),
+		},
+	}, &result)
+	if se, err := result.storageEngine(v30); err != nil || se != wiredTiger {
+		test.Errorf("Expected %s. Received %s, err: %v", wiredTiger, se, err)
+	}
+	if first, last, err := result.oplogTimes(); err != nil || first != 1<<32 || last != 2<<32 {
+		test.Errorf("Expected oplog times %d and %d. Received %d and %d, err: %v", 1<<32, 2<<32, first, last,
+			err)
+	}
+
+	// 2.6 has no storageEngine section
+	var v26 serverStatusResult
+	decodeResponse(test, bson.M{"version": "2.6.12", "uptime": 10.0}, &v26)
+	if se, err := v26.storageEngine(ServerVersion{2, 6, 12}); err != nil || se != mmap {
+		test.Errorf("Expected %s for 2.6. Received %s, err: %v", mmap, se, err)
+	}
+
+	// an error document, or a server without an oplog section
+	var empty serverStatusResult
+	decodeResponse(test, bson.M{"ok": 0.0, "errmsg": "not authorized on admin"}, &empty)
+	if _, err := empty.storageEngine(v44); err == nil || !strings.Contains(err.Error(), "storageEngine.name") {
+		test.Errorf("Expected error naming storageEngine.name. Received %v", err)
+	}
+	if _, _, err := empty.oplogTimes(); err == nil || !strings.Contains(err.Error(), "oplog.earliestOptime") {
+		test.Errorf("Expected error naming oplog.earliestOptime. Received %v", err)
+	}
+}
+
+func TestCmdLineOptsResult(test *testing.T) {
+	cases := []struct {
+		version  string
+		response bson.M
+		expected string
+	}{
+		{"2.4.14", bson.M{"parsed": bson.M{"dbpath": "/srv/mongo", "port": 27017}}, "/srv/mongo"},
+		{"2.6.12", bson.M{"parsed": bson.M{"dbpath": "/srv/mongo"}}, "/srv/mongo"},
+		// 2.6 started with a YAML config file
+		{"2.6.12", bson.M{"parsed": bson.M{"storage": bson.M{"dbPath": "/srv/yaml"}}}, "/srv/yaml"},
+		{"3.0.15", bson.M{"parsed": bson.M{"storage": bson.M{"dbPath": "/srv/mongo"}}}, "/srv/mongo"},
+		{"3.10.0", bson.M{"parsed": bson.M{"storage": bson.M{"dbPath": "/srv/mongo"}}}, "/srv/mongo"},
+		{"4.4.6", bson.M{"parsed": bson.M{"net": bson.M{"port": 27017}}}, "/data/db"},
+		{"7.0.2", bson.M{"parsed": bson.M{"storage": bson.M{"dbPath": "/srv/mongo", "wiredTiger": bson.M{}}}},
+			"/srv/mongo"},
+		{"10.0.0", bson.M{"parsed": bson.M{"dbpath": "/ignored", "storage": bson.M{"dbPath": "/srv/mongo"}}},
+			"/srv/mongo"},
+	}
+	for _, c := range cases {
+		version, err := ParseServerVersion(c.version)
+		if err != nil {
+			test.Fatalf("Failed to parse %s. Err: %v", c.version, err)
+		}
+		var result cmdLineOptsResult
+		decodeResponse(test, c.response, &result)
+		if dbpath, err := result.dbPath(version); err != nil || dbpath != c.expected {
+			test.Errorf("Expected %s from %s %v. Received %s, err: %v", c.expected, c.version, c.response, dbpath,
+				err)
+		}
+	}
+
+	var result cmdLineOptsResult
+	decodeResponse(test, bson.M{"ok": 0.0, "errmsg": "not authorized on admin"}, &result)
+	_, err := result.dbPath(ServerVersion{4, 4, 6})
+	if err == nil || !strings.Contains(err.Error(), "getCmdLineOpts") {
+		test.Errorf("Expected error naming getCmdLineOpts. Received %v", err)
+	}
+}
+
+func TestBuildInfoResult(test *testing.T) {
+	for s, expected := range map[string]ServerVersion{
+		"2.6.12":        {2, 6, 12},
+		"3.10.2":        {3, 10, 2},
+		"4.0.0-rc1":     {4, 0, 0},
+		"4.9.0-alpha-7": {4, 9, 0},
+		"10.0.1":        {10, 0, 1},
+	} {
+		var result buildInfoResult
+		decodeResponse(test, bson.M{"version": s, "versionArray": []int{0, 0, 0, 0}}, &result)
+		if v, err := result.version(); err != nil || v != expected {
+			test.Errorf("Expected %s from %s. Received %s, err: %v", expected, s, v, err)
+		}
+	}
+
+	var result buildInfoResult
+	decodeResponse(test, bson.M{"ok": 0.0}, &result)
+	if _, err := result.version(); err == nil || !strings.Contains(err.Error(), "buildInfo") {
+		test.Errorf("Expected error naming buildInfo. Received %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package components
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Compressor measures how much a codec shrinks a buffer. Implementations must be safe to use from
+// several goroutines.
+type Compressor interface {
+	Name() string
+	CompressedSize(b []byte) (int, error)
+}
+
+const (
+	CodecZlib   = "zlib"
+	CodecGzip   = "gzip"
+	CodecFlate  = "flate"
+	CodecSnappy = "snappy"
+)
+
+var (
+	DefaultBlockCompressor Compressor = &streamCompressor{CodecZlib, flate.DefaultCompression}
+	DefaultOplogCompressor Compressor = snappyCompressor{}
+)
+
+// streamCompressor covers the codecs in compress/, which share compression levels.
+type streamCompressor struct {
+	codec string
+	level int
+}
+
+func (sc *streamCompressor) Name() string {
+	if sc.level == flate.DefaultCompression {
+		return sc.codec
+	}
+	return sc.codec + ":" + strconv.Itoa(sc.level)
+}
+
+func (sc *streamCompressor) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch sc.codec {
+	case CodecZlib:
+		return zlib.NewWriterLevel(w, sc.level)
+	case CodecGzip:
+		return gzip.NewWriterLevel(w, sc.level)
+	case CodecFlate:
+		return flate.NewWriter(w, sc.level)
+	}
+	return nil, fmt.Errorf("Unknown codec %s", sc.codec)
+}
+
+func (sc *streamCompressor) CompressedSize(b []byte) (int, error) {
+	var cb CountingBuffer
+	w, err := sc.newWriter(&cb)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	err = w.Close()
+	if err != nil {
+		return 0, err
+	}
+	return cb.Len(), nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return CodecSnappy
+}
+
+func (snappyCompressor) CompressedSize(b []byte) (int, error) {
+	return len(snappy.Encode(nil, b)), nil
+}
+
+// ParseCompressor accepts a codec name, optionally followed by a compression level for zlib, gzip and
+// flate, e.g. zlib:9.
+func ParseCompressor(spec string) (Compressor, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+	codec := strings.ToLower(parts[0])
+
+	switch codec {
+	case CodecSnappy:
+		if len(parts) > 1 {
+			return nil, fmt.Errorf("%s has no compression levels", CodecSnappy)
+		}
+		return snappyCompressor{}, nil
+	case CodecZlib, CodecGzip, CodecFlate:
+		level := flate.DefaultCompression
+		if len(parts) > 1 {
+			var err error
+			level, err = strconv.Atoi(parts[1])
+			if err != nil || level < flate.HuffmanOnly || level > flate.BestCompression {
+				return nil, fmt.Errorf("Invalid compression level %q for %s. Expected %d to %d", parts[1], codec,
+					flate.HuffmanOnly, flate.BestCompression)
+			}
+		}
+		return &streamCompressor{codec, level}, nil
+	}
+	return nil, fmt.Errorf("Unknown codec %s. Expected %s, %s, %s or %s", parts[0], CodecZlib, CodecGzip,
+		CodecFlate, CodecSnappy)
+}
+
+// ParseCompressors parses a comma separated list of codecs.
+func ParseCompressors(specs string) ([]Compressor, error) {
+	compressors := make([]Compressor, 0)
+	names := make(map[string]bool)
+	for _, spec := range strings.Split(specs, ",") {
+		c, err := ParseCompressor(spec)
+		if err != nil {
+			return nil, err
+		}
+		if names[c.Name()] {
+			return nil, fmt.Errorf("Codec %s is listed more than once", c.Name())
+		}
+		names[c.Name()] = true
+		compressors = append(compressors, c)
+	}
+	return compressors, nil
+}
@@ -0,0 +1,104 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseCompressor(test *testing.T) {
+	names := map[string]string{
+		"zlib":    "zlib",
+		"ZLIB:-1": "zlib",
+		"zlib:9":  "zlib:9",
+		"gzip:1":  "gzip:1",
+		"flate":   "flate",
+		"snappy":  "snappy",
+	}
+	for spec, expected := range names {
+		c, err := ParseCompressor(spec)
+		if err != nil {
+			test.Errorf("Failed to parse %s. Err: %v", spec, err)
+			continue
+		}
+		if c.Name() != expected {
+			test.Errorf("Expected name %s for %s. Received %s", expected, spec, c.Name())
+		}
+	}
+
+	for _, spec := range []string{"lz4", "zlib:10", "zlib:fast", "snappy:1"} {
+		if _, err := ParseCompressor(spec); err == nil {
+			test.Errorf("Expected error parsing %s", spec)
+		}
+	}
+
+	compressors, err := ParseCompressors("zlib, snappy,gzip:9")
+	if err != nil || len(compressors) != 3 {
+		test.Errorf("Expected 3 compressors. Received %d, err: %v", len(compressors), err)
+	}
+	if _, err := ParseCompressors("zlib,zlib:-1"); err == nil {
+		test.Errorf("Expected error for a repeated codec")
+	}
+}
+
+func TestCompressedSize(test *testing.T) {
+	repeated := bytes.Repeat([]byte("abcdefgh"), 8*kb)
+	random := make([]byte, 64*kb)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, spec := range []string{"zlib", "zlib:1", "gzip", "flate:9", "snappy"} {
+		c, _ := ParseCompressor(spec)
+		small, err := c.CompressedSize(repeated)
+		if err != nil {
+			test.Fatalf("Failed to compress with %s. Err: %v", spec, err)
+		}
+		large, err := c.CompressedSize(random)
+		if err != nil {
+			test.Fatalf("Failed to compress with %s. Err: %v", spec, err)
+		}
+		if small >= len(repeated)/10 || large < len(random) {
+			test.Errorf("Unexpected sizes with %s. Repeated: %d, random: %d", spec, small, large)
+		}
+	}
+}
+
+func TestBlockCompressors(test *testing.T) {
+	dataDir, hashDir, cleanup := tempDirs(test)
+	defer cleanup()
+
+	// half random, half repeated
+	data := bytes.Repeat([]byte("0123456789"), mb/10)
+	rand.New(rand.NewSource(1)).Read(data[:len(data)/2])
+	ioutil.WriteFile(filepath.Join(dataDir, "collection-0-1.wt"), data, 0666)
+
+	compressors, _ := ParseCompressors("snappy,zlib:9")
+	opts := BackupSizingOpts{
+		FalsePosRate:     0.01,
+		HashDir:          hashDir,
+		NumCPUs:          runtime.NumCPU(),
+		Offline:          true,
+		DbPath:           dataDir,
+		StorageEngine:    wiredTiger,
+		BlockCompressors: compressors,
+	}
+	bs, err := GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb}, 0)
+	if err != nil {
+		test.Fatalf("Failed to hash %s. Err: %v", dataDir, err)
+	}
+
+	stat := (*bs)[64*kb]
+	if len(stat.CompressionRatios) != 2 {
+		test.Fatalf("Expected 2 compression ratios. Received %v", stat.CompressionRatios)
+	}
+	if stat.DataCompressionRatio != stat.CompressionRatios["snappy"] {
+		test.Errorf("Expected the snappy ratio %f as the data compression ratio. Received %f",
+			stat.CompressionRatios["snappy"], stat.DataCompressionRatio)
+	}
+	if stat.CompressionRatios["zlib:9"] <= stat.CompressionRatios["snappy"] {
+		test.Errorf("Expected zlib:9 to compress better than snappy. Received %v", stat.CompressionRatios)
+	}
+}
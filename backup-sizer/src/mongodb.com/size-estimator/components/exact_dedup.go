@@ -0,0 +1,426 @@
+package components
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DedupMode decides how blocks are matched against the previous iteration. The Bloom filter is small
+// but over counts duplicates by up to the false positive rate. The exact modes count true matches,
+// either with every previous digest held in memory or by merging sorted copies of the hash files on
+// disk. The memory DedupExact needs grows with the number of blocks in the dedup window, so only
+// DedupSorted scales to a dbpath whose hashes don't fit in RAM.
+type DedupMode string
+
+const (
+	DedupBloom  DedupMode = "bloom"
+	DedupExact  DedupMode = "exact"
+	DedupSorted DedupMode = "sorted"
+)
+
+func ParseDedupMode(name string) (DedupMode, error) {
+	switch DedupMode(strings.ToLower(name)) {
+	case DedupBloom:
+		return DedupBloom, nil
+	case DedupExact:
+		return DedupExact, nil
+	case DedupSorted:
+		return DedupSorted, nil
+	}
+	return "", fmt.Errorf("Unknown dedup mode %s. Expected %s, %s or %s", name, DedupBloom, DedupExact,
+		DedupSorted)
+}
+
+const (
+	sortedHashSuffix = ".sorted"
+	sortRunHashes    = 1 << 20 // digests sorted in memory at a time
+)
+
+// openPrevHashes converts fileName first if it is an old text hash file. It returns nil if the file
+// does not exist.
+func openPrevHashes(fileName string, digestSize int) (*HashReader, error) {
+	exists, err := CheckExists(fileName)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	hr, err := OpenHashFile(fileName)
+	if err == NotHashFileError {
+		if err := ConvertTextHashFile(fileName, digestSize); err != nil {
+			return nil, err
+		}
+		hr, err = OpenHashFile(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hr.Header.DigestSize < digestSize {
+		hr.Close()
+		return nil, fmt.Errorf("%s holds %d byte digests, fewer than the %d requested", fileName,
+			hr.Header.DigestSize, digestSize)
+	}
+	return hr, nil
+}
+
+// hashSet holds every digest of an iteration, truncated to the same size.
+type hashSet map[string]struct{}
+
+func (set hashSet) Contains(digest []byte) bool {
+	_, ok := set[string(digest)]
+	return ok
+}
+
+// Add returns false if digest was already in the set.
+func (set hashSet) Add(digest []byte) bool {
+	key := string(digest)
+	if _, ok := set[key]; ok {
+		return false
+	}
+	set[key] = struct{}{}
+	return true
+}
+
+// hashAges maps each digest of the previous iterations to how many iterations ago it was last seen.
+type hashAges map[string]int
+
+// loadPrevHashAges reads the hash files of the previous iterations, newest first.
+func loadPrevHashAges(fileNames []string, digestSize int) (hashAges, error) {
+	ages := hashAges{}
+	// oldest first, so newer iterations overwrite the age
+	for i := len(fileNames) - 1; i >= 0; i-- {
+		prevFile, err := openPrevHashes(fileNames[i], digestSize)
+		if err != nil {
+			return nil, err
+		}
+		if prevFile == nil {
+			continue
+		}
+
+		var digest []byte
+		for {
+			digest, err = prevFile.Next(digest)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				prevFile.Close()
+				return nil, err
+			}
+			ages[string(digest[:digestSize])] = i + 1
+		}
+		prevFile.Close()
+	}
+	return ages, nil
+}
+
+// Age returns 0 if digest is not in any previous iteration.
+func (ages hashAges) Age(digest []byte) int {
+	return ages[string(digest)]
+}
+
+type digestSlice [][]byte
+
+func (ds digestSlice) Len() int           { return len(ds) }
+func (ds digestSlice) Less(i, j int) bool { return bytes.Compare(ds[i], ds[j]) < 0 }
+func (ds digestSlice) Swap(i, j int)      { ds[i], ds[j] = ds[j], ds[i] }
+
+// sortedHashFile returns the name of a sorted copy of fileName, creating it if it is missing or holds
+// digests of a different size.
+func sortedHashFile(fileName string, digestSize int) (string, error) {
+	sorted := fileName + sortedHashSuffix
+	hr, err := OpenHashFile(sorted)
+	if err == nil {
+		hr.Close()
+		if hr.Header.DigestSize == digestSize {
+			return sorted, nil
+		}
+	}
+	return sorted, SortHashFile(fileName, sorted, digestSize, sortRunHashes)
+}
+
+// SortHashFile writes the digests of src, truncated to digestSize, to dst in ascending order. At most
+// runSize digests are held in memory. Larger files are sorted in runs, which are merged.
+func SortHashFile(src string, dst string, digestSize int, runSize int) error {
+	in, err := openPrevHashes(src, digestSize)
+	if err != nil {
+		return err
+	}
+	if in == nil {
+		return fmt.Errorf("Hash file %s does not exist", src)
+	}
+	defer in.Close()
+
+	runs := make([]string, 0)
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+	}()
+
+	buf := make(digestSlice, 0, runSize)
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		sort.Sort(buf)
+		run := dst + ".run" + strconv.Itoa(len(runs))
+		runs = append(runs, run)
+		if err := writeDigests(run, &in.Header, digestSize, buf); err != nil {
+			return err
+		}
+		buf = buf[:0]
+		return nil
+	}
+
+	for {
+		digest, err := in.Next(nil)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buf = append(buf, digest[:digestSize])
+		if len(buf) == runSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(runs) == 0 {
+		// everything fit in memory
+		sort.Sort(buf)
+		tmp := dst + ".tmp"
+		if err := writeDigests(tmp, &in.Header, digestSize, buf); err != nil {
+			return err
+		}
+		return os.Rename(tmp, dst)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return mergeHashFiles(runs, dst, &in.Header, digestSize)
+}
+
+func writeDigests(fileName string, header *HashFileHeader, digestSize int, digests [][]byte) error {
+	hw, err := CreateHashFile(fileName, header.BlockSize, header.Iteration, digestSize)
+	if err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		if err := hw.Write(digest); err != nil {
+			hw.Close()
+			return err
+		}
+	}
+	return hw.Close()
+}
+
+type mergeEntry struct {
+	digest []byte
+	reader *HashReader
+}
+
+type mergeHeap []*mergeEntry
+
+func (mh mergeHeap) Len() int            { return len(mh) }
+func (mh mergeHeap) Less(i, j int) bool  { return bytes.Compare(mh[i].digest, mh[j].digest) < 0 }
+func (mh mergeHeap) Swap(i, j int)       { mh[i], mh[j] = mh[j], mh[i] }
+func (mh *mergeHeap) Push(x interface{}) { *mh = append(*mh, x.(*mergeEntry)) }
+func (mh *mergeHeap) Pop() interface{} {
+	old := *mh
+	entry := old[len(old)-1]
+	*mh = old[:len(old)-1]
+	return entry
+}
+
+// mergeHashFiles merges sorted runs into dst.
+func mergeHashFiles(runs []string, dst string, header *HashFileHeader, digestSize int) error {
+	mh := make(mergeHeap, 0, len(runs))
+	defer func() {
+		for _, entry := range mh {
+			entry.reader.Close()
+		}
+	}()
+
+	for _, run := range runs {
+		hr, err := OpenHashFile(run)
+		if err != nil {
+			return err
+		}
+		digest, err := hr.Next(nil)
+		if err != nil {
+			hr.Close()
+			return err
+		}
+		mh = append(mh, &mergeEntry{digest, hr})
+	}
+	heap.Init(&mh)
+
+	tmp := dst + ".tmp"
+	hw, err := CreateHashFile(tmp, header.BlockSize, header.Iteration, digestSize)
+	if err != nil {
+		return err
+	}
+	for mh.Len() > 0 {
+		entry := mh[0]
+		if err := hw.Write(entry.digest); err != nil {
+			hw.Close()
+			return err
+		}
+		entry.digest, err = entry.reader.Next(entry.digest)
+		if err == io.EOF {
+			heap.Pop(&mh)
+			entry.reader.Close()
+			continue
+		}
+		if err != nil {
+			hw.Close()
+			return err
+		}
+		heap.Fix(&mh, 0)
+	}
+	if err := hw.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// sortedCursor steps through a sorted hash file, up to a given digest.
+type sortedCursor struct {
+	hr     *HashReader
+	digest []byte
+	err    error
+}
+
+func openSortedCursor(fileName string) (*sortedCursor, error) {
+	hr, err := OpenHashFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	c := &sortedCursor{hr: hr}
+	c.digest, c.err = hr.Next(nil)
+	return c, nil
+}
+
+// contains advances the cursor past the digests smaller than digest, which must not be smaller than
+// the one it was last called with, and reports whether the file holds digest.
+func (c *sortedCursor) contains(digest []byte) (bool, error) {
+	for c.err == nil && bytes.Compare(c.digest, digest) < 0 {
+		c.digest, c.err = c.hr.Next(c.digest)
+	}
+	if c.err != nil && c.err != io.EOF {
+		return false, c.err
+	}
+	return c.err == nil && bytes.Equal(c.digest, digest), nil
+}
+
+func (c *sortedCursor) Close() error {
+	return c.hr.Close()
+}
+
+// countSortedRepeats counts the digests in a sorted hash file that are the same as the one before.
+func countSortedRepeats(fileName string) (int, error) {
+	hr, err := OpenHashFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer hr.Close()
+
+	repeats := 0
+	var prev, digest []byte
+	for {
+		digest, err = hr.Next(digest)
+		if err == io.EOF {
+			return repeats, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if prev != nil && bytes.Equal(prev, digest) {
+			repeats++
+		}
+		prev = append(prev[:0], digest...)
+	}
+}
+
+// countSortedDupes sorts the hash file of the current iteration, and those of the previous
+// iterations (newest first) if they were not sorted yet. It returns how many current digests were
+// last seen 1, 2, ... iterations ago. The files are merged in a single pass, so memory does not grow
+// with the number of blocks. Repeated digests in the current file all match, as they do when testing
+// each block against the Bloom filter.
+func countSortedDupes(prevHashFiles []string, curHashFile string, digestSize int) ([]int, error) {
+	dupes := make([]int, len(prevHashFiles))
+	cur, err := sortedHashFile(curHashFile, digestSize)
+	if err != nil {
+		return nil, err
+	}
+	curFile, err := OpenHashFile(cur)
+	if err != nil {
+		return nil, err
+	}
+	defer curFile.Close()
+
+	// nil for previous iterations without hashes
+	prevs := make([]*sortedCursor, len(prevHashFiles))
+	defer func() {
+		for _, prev := range prevs {
+			if prev != nil {
+				prev.Close()
+			}
+		}
+	}()
+	for i, prevHashFile := range prevHashFiles {
+		exists, err := CheckExists(prevHashFile)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		prev, err := sortedHashFile(prevHashFile, digestSize)
+		if err != nil {
+			return nil, err
+		}
+		if prevs[i], err = openSortedCursor(prev); err != nil {
+			return nil, err
+		}
+		if size := prevs[i].hr.Header.DigestSize; size != curFile.Header.DigestSize {
+			return nil, fmt.Errorf("Cannot compare %d byte digests in %s with %d byte digests in %s", size,
+				prev, curFile.Header.DigestSize, cur)
+		}
+	}
+
+	var digest []byte
+	for {
+		digest, err = curFile.Next(digest)
+		if err == io.EOF {
+			return dupes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the newest previous iteration holding the digest is how long ago it was last seen
+		for age, prev := range prevs {
+			if prev == nil {
+				continue
+			}
+			found, err := prev.contains(digest)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				dupes[age]++
+				break
+			}
+		}
+	}
+}
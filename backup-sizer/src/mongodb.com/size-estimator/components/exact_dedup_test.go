@@ -0,0 +1,245 @@
+package components
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestParseDedupMode(test *testing.T) {
+	for name, expected := range map[string]DedupMode{"bloom": DedupBloom, "Exact": DedupExact,
+		"sorted": DedupSorted} {
+		mode, err := ParseDedupMode(name)
+		if err != nil || mode != expected {
+			test.Errorf("Expected %s for %s. Received %s, err: %v", expected, name, mode, err)
+		}
+	}
+	if _, err := ParseDedupMode("approximate"); err == nil {
+		test.Errorf("Expected error for unknown dedup mode")
+	}
+}
+
+func TestSortHashFile(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "hashes")
+	defer cleanupDir()
+
+	digests := testDigests(100)
+	src := filepath.Join(dir, "0")
+	if err := writeDigests(src, &HashFileHeader{BlockSize: 64 * kb}, sha256.Size, digests); err != nil {
+		test.Fatalf("Failed to write %s. Err: %v", src, err)
+	}
+
+	// one run, several runs with a short last one
+	for _, runSize := range []int{1000, 7} {
+		dst := filepath.Join(dir, "sorted")
+		if err := SortHashFile(src, dst, 8, runSize); err != nil {
+			test.Fatalf("Failed to sort %s with runs of %d. Err: %v", src, runSize, err)
+		}
+		header, sorted, err := readAllHashes(dst)
+		if err != nil {
+			test.Fatalf("Failed to read %s. Err: %v", dst, err)
+		}
+		if header.DigestSize != 8 || len(sorted) != len(digests) {
+			test.Fatalf("Expected %d 8 byte digests. Received %d of %d bytes", len(digests), len(sorted),
+				header.DigestSize)
+		}
+		if !sort.IsSorted(digestSlice(sorted)) {
+			test.Errorf("Digests are not sorted with runs of %d", runSize)
+		}
+
+		files, _ := ioutil.ReadDir(dir)
+		if len(files) != 2 {
+			test.Errorf("Expected temporary runs to be removed. Found %d files", len(files))
+		}
+	}
+}
+
+func TestCountSortedDupes(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "hashes")
+	defer cleanupDir()
+
+	digests := testDigests(50)
+	prev := filepath.Join(dir, "0")
+	cur := filepath.Join(dir, "1")
+	header := &HashFileHeader{BlockSize: 64 * kb}
+	writeDigests(prev, header, sha256.Size, digests[:30])
+	// 20 new digests, and one old digest twice
+	writeDigests(cur, header, sha256.Size, append(append([][]byte{}, digests[20:]...), digests[25]))
+
+	dupes, err := countSortedDupes([]string{prev}, cur, sha256.Size)
+	if err != nil {
+		test.Fatalf("Failed to count duplicates. Err: %v", err)
+	}
+	if dupes[0] != 11 {
+		test.Errorf("Expected 11 duplicates. Received %d", dupes[0])
+	}
+
+	// digests 0-9 are only in the older iteration
+	older := filepath.Join(dir, "older")
+	writeDigests(older, header, sha256.Size, digests)
+	dupes, err = countSortedDupes([]string{prev, older}, cur, sha256.Size)
+	if err != nil {
+		test.Fatalf("Failed to count duplicates. Err: %v", err)
+	}
+	if dupes[0] != 11 || dupes[1] != 20 {
+		test.Errorf("Expected 11 and 20 duplicates. Received %v", dupes)
+	}
+
+	dupes, err = countSortedDupes([]string{filepath.Join(dir, "missing")}, cur, sha256.Size)
+	if err != nil || dupes[0] != 0 {
+		test.Errorf("Expected no duplicates without a previous iteration. Received %v, err: %v", dupes, err)
+	}
+}
+
+func TestExactDedupModes(test *testing.T) {
+	dataDir, cleanupDataDir := tempDir(test, "data")
+	defer cleanupDataDir()
+
+	data := make([]byte, mb)
+	rand.New(rand.NewSource(1)).Read(data)
+	fn := filepath.Join(dataDir, "collection-0-1.wt")
+	ioutil.WriteFile(fn, data, 0666)
+
+	for _, mode := range []DedupMode{DedupExact, DedupSorted} {
+		hashDir, cleanupHashDir := tempDir(test, "hashes")
+		defer cleanupHashDir()
+
+		opts := BackupSizingOpts{
+			FalsePosRate:  0.01,
+			DedupMode:     mode,
+			HashDir:       hashDir,
+			NumCPUs:       runtime.NumCPU(),
+			Offline:       true,
+			DbPath:        dataDir,
+			StorageEngine: wiredTiger,
+		}
+		if _, err := GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb, 256 * kb}, 0); err != nil {
+			test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+		}
+
+		// change the first quarter of the file
+		changed := append([]byte{}, data...)
+		rand.New(rand.NewSource(2)).Read(changed[:mb/4])
+		ioutil.WriteFile(fn, changed, 0666)
+
+		bs, err := GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb, 256 * kb}, 1)
+		if err != nil {
+			test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+		}
+		for size, stat := range *bs {
+			if stat.DedupRate != 0.75 {
+				test.Errorf("Expected dedup rate 0.75 for block size %d in %s mode. Received %f", size, mode,
+					stat.DedupRate)
+			}
+			if stat.BloomDedupRate < stat.DedupRate {
+				test.Errorf("Bloom filter missed duplicates for block size %d. Received %f", size,
+					stat.BloomDedupRate)
+			}
+		}
+		ioutil.WriteFile(fn, data, 0666)
+	}
+}
+
+func TestIntraSnapshotDedup(test *testing.T) {
+	dataDir, cleanupDataDir := tempDir(test, "data")
+	defer cleanupDataDir()
+
+	// random data followed by a zeroed extent of four 64kb blocks
+	data := make([]byte, mb+256*kb)
+	rand.New(rand.NewSource(1)).Read(data[:mb])
+	ioutil.WriteFile(filepath.Join(dataDir, "collection-0-1.wt"), data, 0666)
+
+	for _, mode := range []DedupMode{DedupBloom, DedupExact, DedupSorted} {
+		hashDir, cleanupHashDir := tempDir(test, "hashes")
+		defer cleanupHashDir()
+
+		opts := BackupSizingOpts{
+			FalsePosRate:  0.01,
+			DedupMode:     mode,
+			HashDir:       hashDir,
+			NumCPUs:       runtime.NumCPU(),
+			Offline:       true,
+			DbPath:        dataDir,
+			StorageEngine: wiredTiger,
+		}
+		bs, err := GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb, 256 * kb}, 0)
+		if err != nil {
+			test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+		}
+
+		if rate := (*bs)[64*kb].IntraDedupRate; rate != 3.0/20 {
+			test.Errorf("Expected intra dedup rate %f for 64kb blocks in %s mode. Received %f", 3.0/20, mode, rate)
+		}
+		if rate := (*bs)[256*kb].IntraDedupRate; rate != 0 {
+			test.Errorf("Expected no repeated 256kb blocks in %s mode. Received %f", mode, rate)
+		}
+		if rate := (*bs)[64*kb].DedupRate; rate != 0 {
+			test.Errorf("Expected dedup rate 0 for the first iteration in %s mode. Received %f", mode, rate)
+		}
+	}
+}
+
+func TestDedupWindow(test *testing.T) {
+	dataDir, cleanupDataDir := tempDir(test, "data")
+	defer cleanupDataDir()
+
+	data := make([]byte, mb)
+	rand.New(rand.NewSource(1)).Read(data)
+	changed := append([]byte{}, data...)
+	rand.New(rand.NewSource(2)).Read(changed[:mb/4])
+	fn := filepath.Join(dataDir, "collection-0-1.wt")
+
+	for _, mode := range []DedupMode{DedupBloom, DedupExact, DedupSorted} {
+		for _, window := range []int{0, 1} {
+			hashDir, cleanupHashDir := tempDir(test, "hashes")
+			defer cleanupHashDir()
+
+			opts := BackupSizingOpts{
+				FalsePosRate:  0.01,
+				DedupMode:     mode,
+				DedupWindow:   window,
+				HashDir:       hashDir,
+				NumCPUs:       runtime.NumCPU(),
+				Offline:       true,
+				DbPath:        dataDir,
+				StorageEngine: wiredTiger,
+			}
+
+			// the first quarter changes and then changes back
+			var bs *AllBlockSizeStats
+			var err error
+			for iter, contents := range [][]byte{data, changed, data} {
+				ioutil.WriteFile(fn, contents, 0666)
+				bs, err = GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb}, iter)
+				if err != nil {
+					test.Fatalf("Failed to hash %s in %s mode. Err: %v", dataDir, mode, err)
+				}
+			}
+
+			stat := (*bs)[64*kb]
+			expected := []float64{0.75, 1}
+			if window == 1 {
+				expected = expected[:1]
+			}
+			if len(stat.WindowDedupRates) != len(expected) {
+				test.Fatalf("Expected %d window dedup rates in %s mode. Received %v", len(expected), mode,
+					stat.WindowDedupRates)
+			}
+			for i, rate := range expected {
+				if stat.WindowDedupRates[i] < rate || (mode != DedupBloom && stat.WindowDedupRates[i] != rate) {
+					test.Errorf("Expected dedup rate %f against %d iterations in %s mode. Received %f", rate, i+1,
+						mode, stat.WindowDedupRates[i])
+				}
+			}
+			if stat.DedupRate != stat.WindowDedupRates[len(expected)-1] {
+				test.Errorf("Expected dedup rate %f for window %d in %s mode. Received %f",
+					stat.WindowDedupRates[len(expected)-1], window, mode, stat.DedupRate)
+			}
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package components
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Hash files hold a fixed size header, the raw (optionally truncated) digests, and a CRC-32C of the
+// digests:
+//
+//	magic "BSH1" | version uint8 | digest size uint8 | reserved uint16 | block size uint32 |
+//	iteration int32 | count uint64 | created unix nanos int64 | digests... | crc uint32
+//
+// All integers are little endian. The count is filled in when the file is closed.
+const (
+	hashFileMagic      = "BSH1"
+	hashFileVersion    = 1
+	hashFileHeaderSize = 32
+	hashFileTrailer    = 4
+
+	MinDigestSize = 4
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	NotHashFileError = errors.New("Not a binary hash file.")
+)
+
+type HashFileHeader struct {
+	DigestSize int
+	BlockSize  int
+	Iteration  int
+	Count      int64
+	Created    time.Time
+}
+
+func (header *HashFileHeader) marshal() []byte {
+	b := make([]byte, hashFileHeaderSize)
+	copy(b, hashFileMagic)
+	b[4] = hashFileVersion
+	b[5] = uint8(header.DigestSize)
+	binary.LittleEndian.PutUint32(b[8:], uint32(header.BlockSize))
+	binary.LittleEndian.PutUint32(b[12:], uint32(int32(header.Iteration)))
+	binary.LittleEndian.PutUint64(b[16:], uint64(header.Count))
+	binary.LittleEndian.PutUint64(b[24:], uint64(header.Created.UnixNano()))
+	return b
+}
+
+func unmarshalHashFileHeader(b []byte) (*HashFileHeader, error) {
+	if len(b) < hashFileHeaderSize || string(b[:4]) != hashFileMagic {
+		return nil, NotHashFileError
+	}
+	if b[4] != hashFileVersion {
+		return nil, fmt.Errorf("Unsupported hash file version %d", b[4])
+	}
+	header := &HashFileHeader{
+		DigestSize: int(b[5]),
+		BlockSize:  int(binary.LittleEndian.Uint32(b[8:])),
+		Iteration:  int(int32(binary.LittleEndian.Uint32(b[12:]))),
+		Count:      int64(binary.LittleEndian.Uint64(b[16:])),
+		Created:    time.Unix(0, int64(binary.LittleEndian.Uint64(b[24:]))),
+	}
+	if header.DigestSize < MinDigestSize || header.DigestSize > sha256.Size {
+		return nil, fmt.Errorf("Invalid digest size %d in hash file header", header.DigestSize)
+	}
+	return header, nil
+}
+
+func ValidateDigestSize(digestSize int) error {
+	if digestSize < MinDigestSize || digestSize > sha256.Size {
+		return fmt.Errorf("Digest size %d must be between %d and %d bytes", digestSize, MinDigestSize,
+			sha256.Size)
+	}
+	return nil
+}
+
+type HashWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	crc    hash.Hash32
+	header HashFileHeader
+}
+
+// CreateHashFile starts a hash file. Digests are truncated to digestSize bytes.
+func CreateHashFile(fileName string, blockSize int, iteration int, digestSize int) (*HashWriter, error) {
+	if err := ValidateDigestSize(digestSize); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	hw := &HashWriter{
+		f:   f,
+		w:   bufio.NewWriter(f),
+		crc: crc32.New(crcTable),
+		header: HashFileHeader{
+			DigestSize: digestSize,
+			BlockSize:  blockSize,
+			Iteration:  iteration,
+			Created:    time.Now(),
+		},
+	}
+	// the count is rewritten on close
+	if _, err := hw.w.Write(hw.header.marshal()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return hw, nil
+}
+
+func (hw *HashWriter) Name() string {
+	return hw.f.Name()
+}
+
+func (hw *HashWriter) Write(digest []byte) error {
+	if len(digest) < hw.header.DigestSize {
+		return fmt.Errorf("Digest of %d bytes is shorter than the file's digest size %d", len(digest),
+			hw.header.DigestSize)
+	}
+	digest = digest[:hw.header.DigestSize]
+	if _, err := hw.w.Write(digest); err != nil {
+		return err
+	}
+	hw.crc.Write(digest)
+	hw.header.Count++
+	return nil
+}
+
+func (hw *HashWriter) Close() error {
+	err := hw.finish()
+	if closeErr := hw.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Abort closes and removes an incomplete hash file, so it is never read as a previous iteration's.
+func (hw *HashWriter) Abort() error {
+	hw.f.Close()
+	return os.Remove(hw.f.Name())
+}
+
+func (hw *HashWriter) finish() error {
+	trailer := make([]byte, hashFileTrailer)
+	binary.LittleEndian.PutUint32(trailer, hw.crc.Sum32())
+	if _, err := hw.w.Write(trailer); err != nil {
+		return err
+	}
+	if err := hw.w.Flush(); err != nil {
+		return err
+	}
+	_, err := hw.f.WriteAt(hw.header.marshal(), 0)
+	return err
+}
+
+type HashReader struct {
+	f      *os.File
+	r      *bufio.Reader
+	crc    hash.Hash32
+	read   int64
+	Header HashFileHeader
+}
+
+// OpenHashFile returns NotHashFileError for files in the old hex text format.
+func OpenHashFile(fileName string) (*HashReader, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("%s is a directory", fileName)
+	}
+
+	r := bufio.NewReader(f)
+	b, err := r.Peek(hashFileHeaderSize)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	header, err := unmarshalHashFileHeader(b)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.Discard(hashFileHeaderSize)
+
+	expected := hashFileHeaderSize + header.Count*int64(header.DigestSize) + hashFileTrailer
+	if fi.Size() != expected {
+		f.Close()
+		return nil, fmt.Errorf("Hash file %s is %d bytes, expected %d for %d hashes. It may be incomplete",
+			fileName, fi.Size(), expected, header.Count)
+	}
+
+	return &HashReader{f: f, r: r, crc: crc32.New(crcTable), Header: *header}, nil
+}
+
+// Next returns the next digest, which is only valid until the following call, or io.EOF once every
+// digest has been read and the checksum verified.
+func (hr *HashReader) Next(digest []byte) ([]byte, error) {
+	if hr.read == hr.Header.Count {
+		trailer := make([]byte, hashFileTrailer)
+		if _, err := io.ReadFull(hr.r, trailer); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(trailer) != hr.crc.Sum32() {
+			return nil, fmt.Errorf("Checksum mismatch in hash file %s", hr.f.Name())
+		}
+		return nil, io.EOF
+	}
+
+	if cap(digest) < hr.Header.DigestSize {
+		digest = make([]byte, hr.Header.DigestSize)
+	}
+	digest = digest[:hr.Header.DigestSize]
+	if _, err := io.ReadFull(hr.r, digest); err != nil {
+		return nil, err
+	}
+	hr.crc.Write(digest)
+	hr.read++
+	return digest, nil
+}
+
+func (hr *HashReader) Close() error {
+	return hr.f.Close()
+}
+
+// hashFileInfo gets the block size and iteration from a hash file path, hashDir/<blocksize>/<iteration>.
+func hashFileInfo(fileName string) (blockSize int, iteration int) {
+	iteration, _ = strconv.Atoi(filepath.Base(fileName))
+	blockSize, _ = strconv.Atoi(filepath.Base(filepath.Dir(fileName)))
+	return
+}
+
+// ConvertTextHashFile rewrites a hash file in the old format, one hex digest per line, as a binary
+// hash file.
+func ConvertTextHashFile(fileName string, digestSize int) error {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	blockSize, iteration := hashFileInfo(fileName)
+	tmp := fileName + ".tmp"
+	dst, err := CreateHashFile(tmp, blockSize, iteration, digestSize)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		digest, err := hex.DecodeString(string(line))
+		if err == nil {
+			err = dst.Write(digest)
+		}
+		if err != nil {
+			dst.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("Failed to convert %s. Err: %v", fileName, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
+
+// ConvertHashDir converts every text hash file under hashDir and returns how many were converted.
+func ConvertHashDir(hashDir string, digestSize int) (int, error) {
+	converted := 0
+	err := filepath.Walk(hashDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if _, err := strconv.Atoi(fi.Name()); err != nil {
+			return nil // not a hash file
+		}
+		hr, err := OpenHashFile(path)
+		if err == nil {
+			return hr.Close()
+		}
+		if err != NotHashFileError {
+			return err
+		}
+		if err := ConvertTextHashFile(path, digestSize); err != nil {
+			return err
+		}
+		converted++
+		return nil
+	})
+	return converted, err
+}
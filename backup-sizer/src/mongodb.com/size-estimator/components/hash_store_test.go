@@ -0,0 +1,186 @@
+package components
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testDigests(n int) [][]byte {
+	digests := make([][]byte, n)
+	for i := range digests {
+		sum := sha256.Sum256([]byte(strconv.Itoa(i)))
+		digests[i] = sum[:]
+	}
+	return digests
+}
+
+func readAllHashes(fileName string) (*HashFileHeader, [][]byte, error) {
+	hr, err := OpenHashFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hr.Close()
+
+	digests := make([][]byte, 0)
+	for {
+		digest, err := hr.Next(nil)
+		if err == io.EOF {
+			return &hr.Header, digests, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		digests = append(digests, digest)
+	}
+}
+
+func TestHashFileRoundTrip(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "hashes")
+	defer cleanupDir()
+
+	digests := testDigests(100)
+	for _, digestSize := range []int{sha256.Size, 8} {
+		fn := filepath.Join(dir, strconv.Itoa(digestSize))
+		hw, err := CreateHashFile(fn, 64*kb, 3, digestSize)
+		if err != nil {
+			test.Fatalf("Failed to create %s. Err: %v", fn, err)
+		}
+		for _, digest := range digests {
+			if err := hw.Write(digest); err != nil {
+				test.Fatalf("Failed to write digest. Err: %v", err)
+			}
+		}
+		if err := hw.Close(); err != nil {
+			test.Fatalf("Failed to close %s. Err: %v", fn, err)
+		}
+
+		fi, err := os.Stat(fn)
+		if err != nil {
+			test.Fatalf("Failed to stat %s. Err: %v", fn, err)
+		}
+		if expected := int64(hashFileHeaderSize + 100*digestSize + hashFileTrailer); fi.Size() != expected {
+			test.Errorf("Expected %d bytes. Received %d", expected, fi.Size())
+		}
+
+		header, read, err := readAllHashes(fn)
+		if err != nil {
+			test.Fatalf("Failed to read %s. Err: %v", fn, err)
+		}
+		if header.BlockSize != 64*kb || header.Iteration != 3 || header.Count != 100 ||
+			header.DigestSize != digestSize {
+			test.Errorf("Unexpected header %+v", header)
+		}
+		for i := range digests {
+			if !bytes.Equal(read[i], digests[i][:digestSize]) {
+				test.Errorf("Digest %d: expected %x, received %x", i, digests[i][:digestSize], read[i])
+			}
+		}
+
+		n, err := numHashes(fn)
+		if err != nil || n != 100 {
+			test.Errorf("Expected 100 hashes. Received %d, err: %v", n, err)
+		}
+	}
+
+	if _, err := CreateHashFile(filepath.Join(dir, "bad"), 64*kb, 0, 2); err == nil {
+		test.Errorf("Expected error for 2 byte digests")
+	}
+}
+
+func TestHashFileCorruption(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "hashes")
+	defer cleanupDir()
+
+	fn := filepath.Join(dir, "0")
+	hw, err := CreateHashFile(fn, 64*kb, 0, sha256.Size)
+	if err != nil {
+		test.Fatalf("Failed to create %s. Err: %v", fn, err)
+	}
+	for _, digest := range testDigests(10) {
+		hw.Write(digest)
+	}
+	hw.Close()
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		test.Fatalf("Failed to read %s. Err: %v", fn, err)
+	}
+
+	// flip a bit in a digest
+	corrupt := append([]byte{}, b...)
+	corrupt[hashFileHeaderSize+5] ^= 1
+	ioutil.WriteFile(fn, corrupt, 0666)
+	if _, _, err := readAllHashes(fn); err == nil {
+		test.Errorf("Expected checksum error")
+	}
+
+	// a file cut short, e.g. by a crash
+	ioutil.WriteFile(fn, b[:len(b)-10], 0666)
+	if _, _, err := readAllHashes(fn); err == nil {
+		test.Errorf("Expected error for truncated file")
+	}
+}
+
+func TestConvertTextHashFile(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "hashes")
+	defer cleanupDir()
+
+	bsDir := filepath.Join(dir, strconv.Itoa(128*kb))
+	os.MkdirAll(bsDir, 0777)
+	fn := filepath.Join(bsDir, "2")
+
+	digests := testDigests(20)
+	var text bytes.Buffer
+	for _, digest := range digests {
+		text.WriteString(hex.EncodeToString(digest) + "\n")
+	}
+	ioutil.WriteFile(fn, text.Bytes(), 0666)
+
+	if _, err := OpenHashFile(fn); err != NotHashFileError {
+		test.Errorf("Expected NotHashFileError for text file. Received %v", err)
+	}
+	n, err := numHashes(fn)
+	if err != nil || n != 20 {
+		test.Errorf("Expected 20 hashes in text file. Received %d, err: %v", n, err)
+	}
+
+	converted, err := ConvertHashDir(dir, sha256.Size)
+	if err != nil || converted != 1 {
+		test.Fatalf("Expected 1 converted file. Received %d, err: %v", converted, err)
+	}
+	header, read, err := readAllHashes(fn)
+	if err != nil {
+		test.Fatalf("Failed to read converted file. Err: %v", err)
+	}
+	if header.BlockSize != 128*kb || header.Iteration != 2 || len(read) != 20 {
+		test.Errorf("Unexpected converted file. Header %+v, %d digests", header, len(read))
+	}
+
+	// already converted
+	converted, err = ConvertHashDir(dir, sha256.Size)
+	if err != nil || converted != 0 {
+		test.Errorf("Expected no converted files. Received %d, err: %v", converted, err)
+	}
+
+	// a failed conversion is not counted
+	ioutil.WriteFile(filepath.Join(bsDir, "3"), []byte("not hex\n"), 0666)
+	converted, err = ConvertHashDir(dir, sha256.Size)
+	if err == nil || converted != 0 {
+		test.Errorf("Expected an error and no converted files. Received %d, err: %v", converted, err)
+	}
+
+	bf, err := loadPrevHashes(fn, 0.01, 8)
+	if err != nil {
+		test.Fatalf("Failed to load hashes. Err: %v", err)
+	}
+	if !bf.Test(digests[0][:8]) {
+		test.Errorf("Expected truncated digest in bloom filter")
+	}
+}
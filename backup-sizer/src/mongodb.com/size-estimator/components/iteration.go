@@ -0,0 +1,40 @@
+package components
+
+import (
+	"time"
+)
+
+// Components of an iteration, as listed in IterationStats.Missing.
+const (
+	ComponentOplog     = "oplog"
+	ComponentSize      = "size"
+	ComponentBlocks    = "blocks"
+	ComponentChunks    = "chunks"
+	ComponentBreakdown = "breakdown"
+	// the blocks were counted, but no earlier iteration left hashes to dedup them against
+	ComponentDedup = "dedup"
+)
+
+// IterationStats holds everything collected during a single iteration of the estimator. For a sharded
+// cluster, OplogStats and SizeStats are the sum over Shards. Components that failed are listed in
+// Missing, and their stats are nil.
+type IterationStats struct {
+	Iteration  int
+	Start      time.Time
+	OplogStats *OplogStats
+	SizeStats  *SizeStats
+	BlockStats *AllBlockSizeStats
+	ChunkStats *BlockStats   `json:",omitempty"` // content defined chunks, if enabled
+	Breakdown  *Breakdown    `json:",omitempty"` // by file and database, if enabled
+	Shards     []*ShardStats `json:",omitempty"`
+	Missing    []string      `json:",omitempty"`
+}
+
+func (stats *IterationStats) hasMissing(component string) bool {
+	for _, c := range stats.Missing {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
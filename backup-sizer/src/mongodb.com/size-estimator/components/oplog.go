@@ -2,11 +2,13 @@ package components
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/golang/snappy"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"math"
 	"time"
 )
 
@@ -25,6 +27,28 @@ type OplogStats struct {
 	CompressedGbPerDay float64
 }
 
+// MarshalJSON reports ratios that could not be computed (no oplog entries in the interval) as null
+// rather than failing on NaN.
+func (stats OplogStats) MarshalJSON() ([]byte, error) {
+	type plain OplogStats
+	return json.Marshal(&struct {
+		plain
+		CompressionRatio   *float64
+		CompressedGbPerDay *float64
+	}{
+		plain(stats),
+		finiteOrNil(stats.CompressionRatio),
+		finiteOrNil(stats.CompressedGbPerDay),
+	})
+}
+
+func finiteOrNil(f float64) *float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return &f
+}
+
 var OplogNotFoundError = errors.New("local.oplog.rs does not seem to exist.\n")
 
 func (info *OplogInfo) GbPerDay() (float64, error) {
@@ -72,6 +96,17 @@ func GetOplogIterator(startTime time.Time, timeInterval time.Duration,
 }
 
 func CompressionRatio(iter *mgo.Iter) (float64, error) {
+	return CompressionRatioWith(iter, DefaultOplogCompressor)
+}
+
+// CompressionRatioWith compresses the documents in batches of at least 10MB. It returns NaN if there
+// are no documents.
+func CompressionRatioWith(iter *mgo.Iter, compressor Compressor) (float64, error) {
+	return compressionRatio(context.Background(), iter, compressor)
+}
+
+// compressionRatio stops early with ctx's error when ctx is done.
+func compressionRatio(ctx context.Context, iter *mgo.Iter, compressor Compressor) (float64, error) {
 	const MB = 1024 * 1024
 
 	var doc *bson.D = new(bson.D)
@@ -83,6 +118,9 @@ func CompressionRatio(iter *mgo.Iter) (float64, error) {
 	var dataBuffer bytes.Buffer
 
 	for iter.Next(doc) == true {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		docBytes, err := bson.Marshal(doc)
 		if err != nil {
 			return 0, err
@@ -94,8 +132,11 @@ func CompressionRatio(iter *mgo.Iter) (float64, error) {
 		if len(dataBuffer.Bytes()) > minSize {
 			uncompressed = uncompressed + len(dataBuffer.Bytes())
 
-			compressedBytes := snappy.Encode(nil, dataBuffer.Bytes())
-			compressed = compressed + len(compressedBytes)
+			compressedLen, err := compressor.CompressedSize(dataBuffer.Bytes())
+			if err != nil {
+				return 0, err
+			}
+			compressed = compressed + compressedLen
 
 			dataBuffer.Reset()
 		}
@@ -104,35 +145,30 @@ func CompressionRatio(iter *mgo.Iter) (float64, error) {
 	if len(dataBuffer.Bytes()) != 0 {
 		uncompressed = uncompressed + len(dataBuffer.Bytes())
 
-		compressedBytes := snappy.Encode(nil, dataBuffer.Bytes())
-		compressed = compressed + len(compressedBytes)
+		compressedLen, err := compressor.CompressedSize(dataBuffer.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		compressed = compressed + compressedLen
 	}
 
 	return float64(uncompressed) / float64(compressed), nil
 }
 
 func GetOplogInfo(session *mgo.Session) (*OplogInfo, error) {
-	exists, err := collExists(session.DB("local").C("oplog.rs"))
+	oplog, err := getOplogColl(session)
 	if err != nil {
 		return nil, err
 	}
-	if !exists {
-		return nil, OplogNotFoundError
-	}
 
-	var result bson.M
-	err = serverStatus(session, &result)
+	version, err := getMongodVersion(session)
+	if err != nil {
+		return nil, err
+	}
+	firstMTS, lastMTS, err := getOplogTimes(session, oplog, version)
 	if err != nil {
 		return nil, err
 	}
-
-	times := result["oplog"].(bson.M)
-
-	var firstMTS bson.MongoTimestamp
-	var lastMTS bson.MongoTimestamp
-
-	firstMTS = times["earliestOptime"].(bson.MongoTimestamp)
-	lastMTS = times["latestOptime"].(bson.MongoTimestamp)
 
 	size, err := getOplogSize(session)
 	if err != nil {
@@ -146,34 +182,47 @@ func GetOplogInfo(session *mgo.Session) (*OplogInfo, error) {
 	}, nil
 }
 
-func getMongodVersion(session *mgo.Session) (string, error) {
-	cmd := bson.D{
-		{"buildInfo", 1},
+// getOplogTimes asks serverStatus for the optimes of the first and last oplog entries on servers before
+// 3.0. Newer servers, and older ones that don't report them, have the entries read in natural order,
+// which is insertion order for the capped oplog with every storage engine.
+func getOplogTimes(session *mgo.Session, oplog *mgo.Collection,
+	version ServerVersion) (first, last bson.MongoTimestamp, err error) {
+	if !version.AtLeast(3, 0) {
+		var result serverStatusResult
+		if err := serverStatus(session, &result); err != nil {
+			return 0, 0, err
+		}
+		if first, last, err := result.oplogTimes(); err == nil {
+			return first, last, nil
+		}
 	}
-	var result (bson.M)
 
-	if err := session.DB("admin").Run(cmd, &result); err != nil {
-		return "", err
+	if first, err = naturalOplogTime(oplog, "$natural"); err != nil {
+		return 0, 0, err
 	}
-
-	return result["version"].(string), nil
+	if last, err = naturalOplogTime(oplog, "-$natural"); err != nil {
+		return 0, 0, err
+	}
+	return first, last, nil
 }
 
-func getOplogSize(session *mgo.Session) (int, error) {
-	var result (bson.M)
-	err := session.DB("local").Run(bson.D{{"collStats", "oplog.rs"}}, &result)
-
-	if err != nil {
-		return -1, err
+func naturalOplogTime(oplog *mgo.Collection, sort string) (bson.MongoTimestamp, error) {
+	var entry oplogEntryTime
+	if err := oplog.Find(nil).Sort(sort).Select(bson.M{"ts": 1}).One(&entry); err != nil {
+		return 0, fmt.Errorf("Failed to read the oplog sorted by %s. Err: %v", sort, err)
 	}
-	if result["capped"] == false {
-		return -1, errors.New("Oplog is not capped")
+	if entry.Ts == 0 {
+		return 0, fmt.Errorf("Expected the oplog entry sorted by %s to have a ts", sort)
 	}
+	return entry.Ts, nil
+}
 
-	if result["maxSize"] != nil {
-		return result["maxSize"].(int), nil
+func getOplogSize(session *mgo.Session) (int, error) {
+	var result oplogCollStatsResult
+	if err := session.DB("local").Run(bson.D{{"collStats", "oplog.rs"}}, &result); err != nil {
+		return -1, fmt.Errorf("Failed to run collStats on the oplog. Err: %v", err)
 	}
-	return result["size"].(int), nil
+	return result.size()
 }
 
 func getOplogColl(session *mgo.Session) (*mgo.Collection, error) {
@@ -190,7 +239,14 @@ func getOplogColl(session *mgo.Session) (*mgo.Collection, error) {
 	return oplog, nil
 }
 
-func GetOplogStats(session *mgo.Session, timeInterval time.Duration) (*OplogStats, error) {
+// GetOplogStats uses DefaultOplogCompressor if compressor is nil. Reading the oplog stops early if ctx
+// is done.
+func GetOplogStats(ctx context.Context, session *mgo.Session, timeInterval time.Duration,
+	compressor Compressor) (*OplogStats, error) {
+	if compressor == nil {
+		compressor = DefaultOplogCompressor
+	}
+
 	oplogInfo, err := GetOplogInfo(session)
 	if err != nil {
 		return nil, err
@@ -206,7 +262,7 @@ func GetOplogStats(session *mgo.Session, timeInterval time.Duration) (*OplogStat
 	}
 	defer iter.Close()
 
-	cr, err := CompressionRatio(iter)
+	cr, err := compressionRatio(ctx, iter, compressor)
 	if err != nil {
 		return nil, err
 	}
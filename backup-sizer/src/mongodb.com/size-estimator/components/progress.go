@@ -0,0 +1,116 @@
+package components
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultProgressInterval = time.Minute
+
+// Progress of a pass over the files in a dbpath. ETA is 0 until some bytes have been read.
+type Progress struct {
+	Pass        string // ComponentBlocks, or ComponentChunks for the content defined chunking pass
+	Files       int
+	TotalFiles  int
+	Bytes       int64
+	TotalBytes  int64
+	Elapsed     time.Duration
+	BytesPerSec float64
+	ETA         time.Duration
+	Done        bool // the last report of the pass
+}
+
+// ProgressFunc is called every ProgressInterval during a pass, and once when it ends. It is called from
+// a single goroutine at a time.
+type ProgressFunc func(Progress)
+
+type progressTracker struct {
+	fn         ProgressFunc
+	pass       string
+	totalFiles int
+	totalBytes int64
+	start      time.Time
+	files      int64 // updated atomically
+	bytes      int64 // updated atomically
+	stop       chan struct{}
+	stopped    sync.WaitGroup
+}
+
+// newProgressTracker reports every interval until finish is called. A nil fn tracks nothing.
+func newProgressTracker(fn ProgressFunc, interval time.Duration, pass string, totalFiles int,
+	totalBytes int64) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	pt := &progressTracker{
+		fn:         fn,
+		pass:       pass,
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		start:      time.Now(),
+		stop:       make(chan struct{}),
+	}
+	pt.stopped.Add(1)
+	go func() {
+		defer pt.stopped.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn(pt.progress())
+			case <-pt.stop:
+				return
+			}
+		}
+	}()
+	return pt
+}
+
+func (pt *progressTracker) fileDone() {
+	if pt != nil {
+		atomic.AddInt64(&pt.files, 1)
+	}
+}
+
+func (pt *progressTracker) read(n int) {
+	if pt != nil {
+		atomic.AddInt64(&pt.bytes, int64(n))
+	}
+}
+
+func (pt *progressTracker) progress() Progress {
+	p := Progress{
+		Pass:       pt.pass,
+		Files:      int(atomic.LoadInt64(&pt.files)),
+		TotalFiles: pt.totalFiles,
+		Bytes:      atomic.LoadInt64(&pt.bytes),
+		TotalBytes: pt.totalBytes,
+		Elapsed:    time.Since(pt.start),
+	}
+	if secs := p.Elapsed.Seconds(); secs > 0 {
+		p.BytesPerSec = float64(p.Bytes) / secs
+	}
+	// files can grow while they are read
+	if p.BytesPerSec > 0 && p.TotalBytes > p.Bytes {
+		p.ETA = time.Duration(float64(p.TotalBytes-p.Bytes) / p.BytesPerSec * float64(time.Second))
+	}
+	return p
+}
+
+// finish stops the periodic reports and sends the final one.
+func (pt *progressTracker) finish() {
+	if pt == nil {
+		return
+	}
+	close(pt.stop)
+	pt.stopped.Wait()
+	p := pt.progress()
+	p.Done = true
+	pt.fn(p)
+}
@@ -0,0 +1,89 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgress(test *testing.T) {
+	dataDir, hashDir, cleanup := tempDirs(test)
+	defer cleanup()
+
+	for i, size := range []int{mb, 3 * mb, 100} {
+		fn := filepath.Join(dataDir, fmt.Sprintf("collection-%d-1.wt", i))
+		ioutil.WriteFile(fn, make([]byte, size), 0666)
+	}
+
+	var mu sync.Mutex
+	reports := make([]Progress, 0)
+	opts := BackupSizingOpts{
+		FalsePosRate:  0.01,
+		HashDir:       hashDir,
+		NumCPUs:       runtime.NumCPU(),
+		Offline:       true,
+		DbPath:        dataDir,
+		StorageEngine: wiredTiger,
+		// slow enough for periodic reports
+		MaxReadMBps:      32,
+		ProgressInterval: 10 * time.Millisecond,
+		ProgressFunc: func(p Progress) {
+			mu.Lock()
+			reports = append(reports, p)
+			mu.Unlock()
+		},
+	}
+	if _, err := GetBlockHashes(context.Background(), &opts, dataDir, []int{64 * kb, 128 * kb}, 0); err != nil {
+		test.Fatalf("Failed to hash %s. Err: %v", dataDir, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) < 2 {
+		test.Fatalf("Expected periodic progress reports. Received %v", reports)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i].Bytes < reports[i-1].Bytes || reports[i].Files < reports[i-1].Files {
+			test.Errorf("Expected progress to only grow. Received %+v after %+v", reports[i], reports[i-1])
+		}
+	}
+
+	last := reports[len(reports)-1]
+	total := int64(4*mb + 100)
+	if !last.Done || last.Files != 3 || last.TotalFiles != 3 || last.Bytes != total || last.TotalBytes != total {
+		test.Errorf("Expected a final report of 3 files and %d bytes. Received %+v", total, last)
+	}
+	if last.ETA != 0 || last.BytesPerSec <= 0 {
+		test.Errorf("Expected a throughput and no ETA at the end. Received %+v", last)
+	}
+	for _, p := range reports[:len(reports)-1] {
+		if p.Done {
+			test.Errorf("Expected only the last report to be done. Received %+v", p)
+		}
+	}
+	if last.Pass != ComponentBlocks {
+		test.Errorf("Expected the %s pass. Received %s", ComponentBlocks, last.Pass)
+	}
+
+	// chunking reads the files again, and reports it separately
+	var chunkReports []Progress
+	opts.Chunking = NewChunkParams(0, 16*kb, 0)
+	opts.ProgressFunc = func(p Progress) {
+		chunkReports = append(chunkReports, p)
+	}
+	if _, err := GetChunkHashes(context.Background(), &opts, dataDir, 0); err != nil {
+		test.Fatalf("Failed to chunk %s. Err: %v", dataDir, err)
+	}
+	if len(chunkReports) == 0 {
+		test.Fatalf("Expected progress reports from chunking")
+	}
+	last = chunkReports[len(chunkReports)-1]
+	if !last.Done || last.Pass != ComponentChunks || last.Files != 3 || last.Bytes != total || last.TotalBytes != total {
+		test.Errorf("Expected a final %s report of 3 files and %d bytes. Received %+v", ComponentChunks, total, last)
+	}
+}
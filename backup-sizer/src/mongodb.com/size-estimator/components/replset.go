@@ -0,0 +1,218 @@
+package components
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	MemberPrimary   = "primary"
+	MemberSecondary = "secondary"
+	MemberHidden    = "hidden"
+
+	statePrimary   = 1
+	stateSecondary = 2
+)
+
+type ReplSetMember struct {
+	Name     string
+	State    int
+	StateStr string
+	Healthy  bool
+	Hidden   bool
+}
+
+type memberStatus struct {
+	Name     string  `bson:"name"`
+	State    int     `bson:"state"`
+	StateStr string  `bson:"stateStr"`
+	Health   float64 `bson:"health"`
+}
+
+type memberConfig struct {
+	Host   string `bson:"host"`
+	Hidden bool   `bson:"hidden"`
+}
+
+// GetReplSetMembers combines each member's state from replSetGetStatus with whether it is hidden
+// from the replica set config.
+func GetReplSetMembers(session *mgo.Session) ([]ReplSetMember, error) {
+	var status struct {
+		Members []memberStatus `bson:"members"`
+	}
+	if err := session.DB("admin").Run(bson.D{{"replSetGetStatus", 1}}, &status); err != nil {
+		return nil, fmt.Errorf("replSetGetStatus failed. Err: %v", err)
+	}
+
+	var config struct {
+		Members []memberConfig `bson:"members"`
+	}
+	var result struct {
+		Config *struct {
+			Members []memberConfig `bson:"members"`
+		} `bson:"config"`
+	}
+	err := session.DB("admin").Run(bson.D{{"replSetGetConfig", 1}}, &result)
+	if err == nil && result.Config != nil {
+		config.Members = result.Config.Members
+	} else if err := session.DB("local").C("system.replset").Find(nil).One(&config); err != nil {
+		// replSetGetConfig is new in 3.0, older versions only have local.system.replset
+		return nil, fmt.Errorf("Failed to read the replica set config. Err: %v", err)
+	}
+
+	return mergeMembers(status.Members, config.Members), nil
+}
+
+func mergeMembers(status []memberStatus, config []memberConfig) []ReplSetMember {
+	hidden := make(map[string]bool)
+	for _, m := range config {
+		hidden[m.Host] = m.Hidden
+	}
+
+	members := make([]ReplSetMember, 0, len(status))
+	for _, m := range status {
+		members = append(members, ReplSetMember{
+			Name:     m.Name,
+			State:    m.State,
+			StateStr: m.StateStr,
+			Healthy:  m.Health == 1,
+			Hidden:   hidden[m.Name],
+		})
+	}
+	return members
+}
+
+// SelectMember picks the primary, the first visible secondary, the first hidden member, or the
+// member with the given host:port.
+func SelectMember(members []ReplSetMember, choice string) (string, error) {
+	for _, m := range members {
+		if !m.Healthy {
+			continue
+		}
+		switch choice {
+		case MemberPrimary:
+			if m.State == statePrimary {
+				return m.Name, nil
+			}
+		case MemberSecondary:
+			if m.State == stateSecondary && !m.Hidden {
+				return m.Name, nil
+			}
+		case MemberHidden:
+			if m.State == stateSecondary && m.Hidden {
+				return m.Name, nil
+			}
+		default:
+			if m.Name != choice {
+				continue
+			}
+			if m.State != statePrimary && m.State != stateSecondary {
+				return "", fmt.Errorf("Member %s is %s", m.Name, m.StateStr)
+			}
+			return m.Name, nil
+		}
+	}
+	return "", fmt.Errorf("No healthy replica set member matches %s", choice)
+}
+
+// MemberSession connects directly to the member chosen with Member, allowing reads if it is a
+// secondary, so all commands and the oplog scan run there.
+func (opts BackupSizingOpts) MemberSession() (*mgo.Session, error) {
+	info, err := opts.DialInfo()
+	if err != nil {
+		return nil, err
+	}
+	seed, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	members, err := GetReplSetMembers(seed)
+	seed.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := SelectMember(members, opts.Member)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Addrs = []string{host}
+	info.Direct = true
+	info.ReplicaSetName = ""
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	session.SetMode(mgo.Monotonic, true)
+	return session, nil
+}
+
+// VerifyLocalDbPath checks that dbpath is the data directory of the mongod the session is connected
+// to: the mongod must run on this host, and its pid must be the one in mongod.lock. The pid alone is
+// not enough, since in containers mongod is often pid 1 on every member.
+func VerifyLocalDbPath(session *mgo.Session, dbpath string) error {
+	var status struct {
+		Host string `bson:"host"`
+		Pid  int64  `bson:"pid"`
+	}
+	if err := session.DB("admin").Run(bson.D{{"serverStatus", 1}}, &status); err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	if err := checkLocalMongod(dbpath, status.Host, status.Pid, hostname); err != nil {
+		// the files are another mongod's, which later attempts won't change
+		return Permanent(fmt.Errorf("%s does not belong to %s. Err: %v", dbpath, status.Host, err))
+	}
+	return nil
+}
+
+func checkLocalMongod(dbpath string, serverHost string, pid int64, hostname string) error {
+	if err := checkSameHost(serverHost, hostname); err != nil {
+		return err
+	}
+	return checkLockPid(dbpath, pid)
+}
+
+// checkSameHost compares the host serverStatus reports, which may have a port, with this host's name.
+// Either may be fully qualified.
+func checkSameHost(serverHost string, hostname string) error {
+	host := serverHost
+	if h, _, err := net.SplitHostPort(serverHost); err == nil {
+		host = h
+	}
+	a, b := strings.ToLower(host), strings.ToLower(hostname)
+	if a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".") {
+		return nil
+	}
+	return fmt.Errorf("mongod runs on %s, not on this host %s", host, hostname)
+}
+
+func checkLockPid(dbpath string, pid int64) error {
+	b, err := ioutil.ReadFile(filepath.Join(dbpath, "mongod.lock"))
+	if err != nil {
+		return err
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		return fmt.Errorf("mongod.lock is empty, no mongod is running on it")
+	}
+	lockPid, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Failed to parse mongod.lock. Err: %v", err)
+	}
+	if lockPid != pid {
+		return fmt.Errorf("mongod.lock is held by pid %d, not %d", lockPid, pid)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package components
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelectMember(test *testing.T) {
+	members := mergeMembers(
+		[]memberStatus{
+			{"a:27017", 1, "PRIMARY", 1},
+			{"b:27017", 8, "(not reachable/healthy)", 0},
+			{"c:27017", 3, "RECOVERING", 1},
+			{"d:27017", 2, "SECONDARY", 1},
+			{"e:27017", 2, "SECONDARY", 1},
+		},
+		[]memberConfig{
+			{"a:27017", false},
+			{"b:27017", false},
+			{"c:27017", false},
+			{"d:27017", true},
+			{"e:27017", false},
+		})
+
+	testCases := []struct {
+		choice   string
+		expected string
+	}{
+		{MemberPrimary, "a:27017"},
+		{MemberSecondary, "e:27017"},
+		{MemberHidden, "d:27017"},
+		{"d:27017", "d:27017"},
+		{"a:27017", "a:27017"},
+	}
+	for _, testCase := range testCases {
+		host, err := SelectMember(members, testCase.choice)
+		if err != nil {
+			test.Errorf("Unexpected error selecting %s. Err: %v", testCase.choice, err)
+		}
+		if host != testCase.expected {
+			test.Errorf("Expected %s for %s. Received %s", testCase.expected, testCase.choice, host)
+		}
+	}
+
+	for _, choice := range []string{"b:27017", "c:27017", "f:27017"} {
+		if host, err := SelectMember(members, choice); err == nil {
+			test.Errorf("Expected error selecting %s. Received %s", choice, host)
+		}
+	}
+}
+
+func TestCheckLockPid(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "lock")
+	defer cleanupDir()
+
+	if err := checkLockPid(dir, 1234); err == nil {
+		test.Errorf("Expected error without mongod.lock")
+	}
+
+	lock := filepath.Join(dir, "mongod.lock")
+	for contents, success := range map[string]bool{"1234\n": true, "4321\n": false, "": false, "abc": false} {
+		if err := ioutil.WriteFile(lock, []byte(contents), 0666); err != nil {
+			test.Fatalf("Failed to write %s. Err: %v", lock, err)
+		}
+		err := checkLockPid(dir, 1234)
+		if success && err != nil {
+			test.Errorf("Unexpected error for mongod.lock %q. Err: %v", contents, err)
+		}
+		if !success && err == nil {
+			test.Errorf("Expected error for mongod.lock %q", contents)
+		}
+	}
+}
+
+func TestCheckLocalMongod(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "lock")
+	defer cleanupDir()
+	// mongod is pid 1 in its container, like on every other member
+	ioutil.WriteFile(filepath.Join(dir, "mongod.lock"), []byte("1\n"), 0666)
+
+	for serverHost, local := range map[string]bool{
+		"mongo-1:27017":             true,
+		"MONGO-1":                   true,
+		"mongo-1.example.com:27017": true,
+		"mongo-2:27017":             false,
+		"mongo-10:27017":            false,
+	} {
+		err := checkLocalMongod(dir, serverHost, 1, "mongo-1")
+		if local && err != nil {
+			test.Errorf("Unexpected error for a mongod on %s. Err: %v", serverHost, err)
+		}
+		if !local && err == nil {
+			test.Errorf("Expected error for a mongod on %s with the same pid", serverHost)
+		}
+	}
+	if err := checkLocalMongod(dir, "mongo-1:27017", 1, "mongo-1.example.com"); err != nil {
+		test.Errorf("Unexpected error for a fully qualified hostname. Err: %v", err)
+	}
+	if err := checkLocalMongod(dir, "mongo-1:27017", 2, "mongo-1"); err == nil {
+		test.Errorf("Expected error for another pid on the same host")
+	}
+}
@@ -0,0 +1,373 @@
+package components
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	day   = 24 * time.Hour
+	week  = 7 * day
+	month = 30 * day
+
+	bytesPerGB = 1024 * 1024 * 1024
+)
+
+// SnapshotSchedule mirrors the Ops Manager snapshot schedule settings.
+type SnapshotSchedule struct {
+	Interval          time.Duration // time between snapshots
+	Retention         time.Duration // how long every snapshot is kept
+	DailyRetention    int           // days
+	WeeklyRetention   int           // weeks
+	MonthlyRetention  int           // months
+	PointInTimeWindow time.Duration
+}
+
+// Ops Manager defaults.
+var DefaultSnapshotSchedule = SnapshotSchedule{
+	Interval:          6 * time.Hour,
+	Retention:         2 * day,
+	DailyRetention:    7,
+	WeeklyRetention:   4,
+	MonthlyRetention:  13,
+	PointInTimeWindow: 24 * time.Hour,
+}
+
+var NoIterationsError = errors.New("No iterations were collected.")
+
+func (sched SnapshotSchedule) Validate() error {
+	if sched.Interval <= 0 || day%sched.Interval != 0 {
+		return fmt.Errorf("Snapshot interval %v must evenly divide 24h", sched.Interval)
+	}
+	if sched.Retention < 0 || sched.PointInTimeWindow < 0 {
+		return fmt.Errorf("Snapshot retention %v and point in time window %v cannot be negative",
+			sched.Retention, sched.PointInTimeWindow)
+	}
+	if sched.DailyRetention < 0 || sched.WeeklyRetention < 0 || sched.MonthlyRetention < 0 {
+		return fmt.Errorf("Daily (%d), weekly (%d) and monthly (%d) retention cannot be negative",
+			sched.DailyRetention, sched.WeeklyRetention, sched.MonthlyRetention)
+	}
+	return nil
+}
+
+// Horizon is how long it takes for the schedule to reach its steady state, i.e. the age of the oldest
+// snapshot that will ever be kept.
+func (sched SnapshotSchedule) Horizon() time.Duration {
+	horizon := sched.Retention
+	for _, d := range []time.Duration{
+		time.Duration(sched.DailyRetention) * day,
+		time.Duration(sched.WeeklyRetention) * week,
+		time.Duration(sched.MonthlyRetention) * month,
+		sched.PointInTimeWindow,
+	} {
+		if d > horizon {
+			horizon = d
+		}
+	}
+	return horizon
+}
+
+func (sched SnapshotSchedule) isRetained(taken, age time.Duration) bool {
+	switch {
+	case age < sched.Retention:
+		return true
+	case taken%day == 0 && age < time.Duration(sched.DailyRetention)*day:
+		return true
+	case taken%week == 0 && age < time.Duration(sched.WeeklyRetention)*week:
+		return true
+	case taken%month == 0 && age < time.Duration(sched.MonthlyRetention)*month:
+		return true
+	}
+	return false
+}
+
+// retainedSnapshots returns when each snapshot still retained after elapsed time was taken, oldest
+// first.
+func (sched SnapshotSchedule) retainedSnapshots(elapsed time.Duration) []time.Duration {
+	taken := make([]time.Duration, 0)
+	for t := time.Duration(0); t <= elapsed; t += sched.Interval {
+		if sched.isRetained(t, elapsed-t) {
+			taken = append(taken, t)
+		}
+	}
+	return taken
+}
+
+type StorageProjection struct {
+	Elapsed         time.Duration
+	Snapshots       int
+	BlockstoreBytes float64
+	OplogStoreBytes float64
+	TotalBytes      float64
+}
+
+type BlockSizeReport struct {
+	BlockSize               int
+	FullSnapshotBytes       float64 // compressed size of a single full snapshot
+	ChangedBytesPerSnapshot float64 // compressed size of the new blocks in each subsequent snapshot
+	Projections             []StorageProjection
+	// dedup rate of the last iteration against its previous 1, 2, ... iterations
+	WindowDedupRates []float64 `json:",omitempty"`
+}
+
+// StorageReport projects the blockstore and oplog store capacity needed to back up the deployment
+// with a given snapshot schedule.
+type StorageReport struct {
+	Schedule             SnapshotSchedule
+	Iterations           int
+	DedupMeasured        bool // false if no iteration had hashes to dedup against. No blocks are then reused
+	OplogGbPerDay        float64
+	BlockSizes           []BlockSizeReport
+	RecommendedBlockSize int
+	// false for a sharded cluster, whose files are not local. Its snapshots are assumed to be full,
+	// uncompressed copies, reported as a single block size of 0.
+	BlocksMeasured bool
+}
+
+var reportHorizons = []time.Duration{day, week, month, 3 * month, 6 * month, 12 * month}
+
+// NewStorageReport combines the results of every iteration. iterInterval is the time between
+// iterations, which is the interval the dedup rate was measured over.
+func NewStorageReport(results []*IterationStats, iterInterval time.Duration, sched SnapshotSchedule) (
+	*StorageReport, error) {
+
+	if err := sched.Validate(); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, NoIterationsError
+	}
+	if iterInterval <= 0 {
+		return nil, fmt.Errorf("Iteration interval %v must be positive", iterInterval)
+	}
+
+	// a sharded cluster's files are not local, so its iterations have no block stats at all
+	blocksMeasured := false
+	for _, res := range results {
+		if res.BlockStats != nil || res.hasMissing(ComponentBlocks) {
+			blocksMeasured = true
+		}
+	}
+
+	// the latest iteration that has what the report needs, in case the last ones failed
+	var last *IterationStats
+	for i := len(results) - 1; i >= 0 && last == nil; i-- {
+		if results[i].SizeStats != nil && (results[i].BlockStats != nil || !blocksMeasured) {
+			last = results[i]
+		}
+	}
+	if last == nil && blocksMeasured {
+		return nil, fmt.Errorf("No iteration has both size and block statistics")
+	}
+	if last == nil {
+		return nil, fmt.Errorf("No iteration has size statistics")
+	}
+
+	report := &StorageReport{
+		Schedule:       sched,
+		Iterations:     len(results),
+		BlocksMeasured: blocksMeasured,
+		OplogGbPerDay:  averageOplogGbPerDay(results),
+	}
+
+	horizon := sched.Horizon()
+	elapsed := make([]time.Duration, 0)
+	for _, h := range reportHorizons {
+		if h < horizon {
+			elapsed = append(elapsed, h)
+		}
+	}
+	elapsed = append(elapsed, horizon)
+
+	blocksizes := make([]int, 0)
+	if blocksMeasured {
+		for bs := range *last.BlockStats {
+			blocksizes = append(blocksizes, bs)
+		}
+		sort.Ints(blocksizes)
+		if len(blocksizes) == 0 {
+			return nil, fmt.Errorf("Iteration %d has no block statistics", last.Iteration)
+		}
+	} else {
+		// a single projection of uncompressed full snapshots
+		blocksizes = append(blocksizes, 0)
+	}
+
+	// the oplog store only depends on the point in time window, not on the block size
+	oplogBytes := func(e time.Duration) float64 {
+		window := sched.PointInTimeWindow
+		if e < window {
+			window = e
+		}
+		return report.OplogGbPerDay * bytesPerGB * float64(window) / float64(day)
+	}
+
+	for _, bs := range blocksizes {
+		full := last.SizeStats.FileSize
+		var windowDedupRates []float64
+		if blocksMeasured {
+			if ratio := (*last.BlockStats)[bs].DataCompressionRatio; ratio > 0 {
+				full /= ratio
+			}
+			windowDedupRates = (*last.BlockStats)[bs].WindowDedupRates
+		}
+
+		dedupRate, samples := averageDedupRate(results, bs)
+		if samples > 0 {
+			report.DedupMeasured = true
+		}
+		changeRate := 1 - dedupRate
+		changed := full * changeRate * float64(sched.Interval) / float64(iterInterval)
+		changed = math.Min(changed, full)
+
+		bsReport := BlockSizeReport{
+			BlockSize:               bs,
+			FullSnapshotBytes:       full,
+			ChangedBytesPerSnapshot: changed,
+			WindowDedupRates:        windowDedupRates,
+		}
+		for _, e := range elapsed {
+			taken := sched.retainedSnapshots(e)
+			blockstore := 0.0
+			for i, t := range taken {
+				if i == 0 {
+					blockstore += full
+					continue
+				}
+				// a snapshot holds every block changed since the previous retained snapshot
+				gap := float64(t-taken[i-1]) / float64(sched.Interval)
+				blockstore += math.Min(full, changed*gap)
+			}
+			oplog := oplogBytes(e)
+			bsReport.Projections = append(bsReport.Projections, StorageProjection{
+				Elapsed:         e,
+				Snapshots:       len(taken),
+				BlockstoreBytes: blockstore,
+				OplogStoreBytes: oplog,
+				TotalBytes:      blockstore + oplog,
+			})
+		}
+		report.BlockSizes = append(report.BlockSizes, bsReport)
+	}
+
+	if !blocksMeasured {
+		return report, nil
+	}
+	best := math.Inf(1)
+	for _, bsReport := range report.BlockSizes {
+		steady := bsReport.Projections[len(bsReport.Projections)-1].TotalBytes
+		if steady < best {
+			best = steady
+			report.RecommendedBlockSize = bsReport.BlockSize
+		}
+	}
+
+	return report, nil
+}
+
+// the first iteration has nothing to dedup against, so it is left out of the average, like those
+// following failed iterations. samples is the number of iterations averaged.
+func averageDedupRate(results []*IterationStats, blocksize int) (rate float64, samples int) {
+	total := 0.0
+	n := 0
+	for _, res := range results {
+		if res.Iteration == 0 || res.BlockStats == nil {
+			continue
+		}
+		stat := (*res.BlockStats)[blocksize]
+		if stat == nil || stat.NoPrevHashes {
+			continue
+		}
+		total += stat.DedupRate
+		n++
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return total / float64(n), n
+}
+
+func averageOplogGbPerDay(results []*IterationStats) float64 {
+	total := 0.0
+	n := 0
+	for _, res := range results {
+		if res.OplogStats == nil {
+			continue
+		}
+		gb := res.OplogStats.CompressedGbPerDay
+		if math.IsNaN(gb) || math.IsInf(gb, 0) {
+			continue
+		}
+		total += gb
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / float64(n)
+}
+
+// WriteText writes a human readable summary of the report.
+func (report *StorageReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(tw, "Projected backup storage (GB) from %d iterations\n", report.Iterations)
+	if !report.BlocksMeasured {
+		fmt.Fprintf(tw, "No block statistics, e.g. for a sharded cluster. Assuming every snapshot is a full, "+
+			"uncompressed copy.\n")
+	} else if !report.DedupMeasured {
+		fmt.Fprintf(tw, "No iteration had a previous one to dedup against. Assuming no blocks are reused "+
+			"between snapshots.\n")
+	}
+	fmt.Fprintf(tw, "Oplog store: %.3f GB/day compressed, %v point in time window\n",
+		report.OplogGbPerDay, report.Schedule.PointInTimeWindow)
+
+	fmt.Fprintf(tw, "BlockSize\t")
+	for _, p := range report.BlockSizes[0].Projections {
+		fmt.Fprintf(tw, "%s\t", formatDays(p.Elapsed))
+	}
+	fmt.Fprintf(tw, "\n")
+
+	for _, bsReport := range report.BlockSizes {
+		if report.BlocksMeasured {
+			fmt.Fprintf(tw, "%d\t", bsReport.BlockSize)
+		} else {
+			fmt.Fprintf(tw, "-\t")
+		}
+		for _, p := range bsReport.Projections {
+			fmt.Fprintf(tw, "%.3f\t", p.TotalBytes/bytesPerGB)
+		}
+		fmt.Fprintf(tw, "\n")
+	}
+	if report.BlocksMeasured {
+		fmt.Fprintf(tw, "Recommended block size: %d\n", report.RecommendedBlockSize)
+	}
+
+	// only worth showing if the window grew past the previous iteration
+	if windows := len(report.BlockSizes[0].WindowDedupRates); windows > 1 {
+		fmt.Fprintf(tw, "Dedup rate against the last N iterations\n")
+		fmt.Fprintf(tw, "BlockSize\t")
+		for n := 1; n <= windows; n++ {
+			fmt.Fprintf(tw, "%d\t", n)
+		}
+		fmt.Fprintf(tw, "\n")
+		for _, bsReport := range report.BlockSizes {
+			fmt.Fprintf(tw, "%d\t", bsReport.BlockSize)
+			for _, rate := range bsReport.WindowDedupRates {
+				fmt.Fprintf(tw, "%.3f\t", rate)
+			}
+			fmt.Fprintf(tw, "\n")
+		}
+	}
+
+	return tw.Flush()
+}
+
+func formatDays(d time.Duration) string {
+	return fmt.Sprintf("%dd", int(d/day))
+}
@@ -0,0 +1,229 @@
+package components
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleValidate(test *testing.T) {
+	if err := DefaultSnapshotSchedule.Validate(); err != nil {
+		test.Errorf("Unexpected error validating default schedule. Err: %v", err)
+	}
+
+	sched := DefaultSnapshotSchedule
+	sched.Interval = 7 * time.Hour
+	if err := sched.Validate(); err == nil {
+		test.Errorf("Expected error for interval %v", sched.Interval)
+	}
+
+	sched = DefaultSnapshotSchedule
+	sched.WeeklyRetention = -1
+	if err := sched.Validate(); err == nil {
+		test.Errorf("Expected error for negative weekly retention")
+	}
+}
+
+func TestRetainedSnapshots(test *testing.T) {
+	sched := DefaultSnapshotSchedule
+
+	testCases := []struct {
+		elapsed  time.Duration
+		expected int
+	}{
+		{0, 1},
+		{day, 5},
+		{2 * day, 8 + 1},            // 8 in the last two days, plus the first daily
+		{7 * day, 8 + 5 + 1},        // plus dailies 2 to 6 days old and the first weekly
+		{390 * day, 8 + 5 + 3 + 12}, // plus 5 dailies, 3 weeklies and 12 monthlies
+	}
+
+	for _, testCase := range testCases {
+		taken := sched.retainedSnapshots(testCase.elapsed)
+		if len(taken) != testCase.expected {
+			test.Errorf("Expected %d snapshots retained after %v. Received %d: %v",
+				testCase.expected, testCase.elapsed, len(taken), taken)
+		}
+	}
+}
+
+func TestStorageReport(test *testing.T) {
+	_, err := NewStorageReport(nil, 6*time.Hour, DefaultSnapshotSchedule)
+	if err != NoIterationsError {
+		test.Errorf("Expected NoIterationsError. Received %v", err)
+	}
+
+	// only keep snapshots for a day, so the steady state is 4 snapshots
+	sched := SnapshotSchedule{
+		Interval:          6 * time.Hour,
+		Retention:         day,
+		PointInTimeWindow: day,
+	}
+
+	results := make([]*IterationStats, 0)
+	for i := 0; i < 3; i++ {
+		dedup := 0.0
+		if i > 0 {
+			dedup = 0.9
+		}
+		results = append(results, &IterationStats{
+			Iteration:  i,
+			OplogStats: &OplogStats{CompressedGbPerDay: 2},
+			SizeStats:  &SizeStats{FileSize: 100 * bytesPerGB},
+			BlockStats: &AllBlockSizeStats{
+				64 * kb: &BlockStats{DedupRate: dedup, DataCompressionRatio: 4,
+					WindowDedupRates: []float64{dedup, dedup}},
+				mb: &BlockStats{DedupRate: dedup / 2, DataCompressionRatio: 5,
+					WindowDedupRates: []float64{dedup / 2, dedup / 2}},
+			},
+		})
+	}
+
+	report, err := NewStorageReport(results, 6*time.Hour, sched)
+	if err != nil {
+		test.Fatalf("Failed to create report. Err: %v", err)
+	}
+	if !report.DedupMeasured {
+		test.Errorf("Expected dedup to be measured with %d iterations", len(results))
+	}
+	if len(report.BlockSizes) != 2 {
+		test.Fatalf("Expected 2 block sizes. Received %d", len(report.BlockSizes))
+	}
+
+	// 64kb: 25GB full, 2.5GB changed per snapshot. 1mb: 20GB full, 11GB changed per snapshot.
+	expected := map[int]float64{
+		64 * kb: (25 + 3*2.5 + 2) * bytesPerGB,
+		mb:      (20 + 3*11 + 2) * bytesPerGB,
+	}
+	for _, bsReport := range report.BlockSizes {
+		steady := bsReport.Projections[len(bsReport.Projections)-1]
+		if steady.Snapshots != 4 {
+			test.Errorf("Expected 4 snapshots at steady state. Received %d", steady.Snapshots)
+		}
+		if math.Abs(steady.TotalBytes-expected[bsReport.BlockSize]) > 1 {
+			test.Errorf("Block size %d: expected %f total bytes, received %f", bsReport.BlockSize,
+				expected[bsReport.BlockSize], steady.TotalBytes)
+		}
+	}
+	if report.RecommendedBlockSize != 64*kb {
+		test.Errorf("Expected recommended block size %d. Received %d", 64*kb, report.RecommendedBlockSize)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteText(&buf); err != nil {
+		test.Fatalf("Failed to write report. Err: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Recommended block size: 65536") {
+		test.Errorf("Report is missing the recommended block size:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Dedup rate against the last N iterations") {
+		test.Errorf("Report is missing the dedup rates by window:\n%s", buf.String())
+	}
+
+	// a single iteration cannot measure dedup, so every snapshot is assumed to be a full copy
+	report, err = NewStorageReport(results[:1], 6*time.Hour, sched)
+	if err != nil {
+		test.Fatalf("Failed to create report. Err: %v", err)
+	}
+	if report.DedupMeasured {
+		test.Errorf("Expected dedup not to be measured with a single iteration")
+	}
+	changed := report.BlockSizes[0].ChangedBytesPerSnapshot
+	if changed != report.BlockSizes[0].FullSnapshotBytes {
+		test.Errorf("Expected every snapshot to be full. Full: %f, changed: %f",
+			report.BlockSizes[0].FullSnapshotBytes, changed)
+	}
+
+	// iterations whose previous hashes were missing are not dedup samples either
+	noPrevHashes := []*IterationStats{results[0]}
+	for i := 1; i < 3; i++ {
+		noPrevHashes = append(noPrevHashes, &IterationStats{
+			Iteration:  i,
+			SizeStats:  results[i].SizeStats,
+			BlockStats: &AllBlockSizeStats{64 * kb: &BlockStats{NoPrevHashes: true, DataCompressionRatio: 4}},
+			Missing:    []string{ComponentDedup},
+		})
+	}
+	report, err = NewStorageReport(noPrevHashes, 6*time.Hour, sched)
+	if err != nil {
+		test.Fatalf("Failed to create report. Err: %v", err)
+	}
+	if report.DedupMeasured {
+		test.Errorf("Expected dedup not to be measured without previous hashes")
+	}
+	if bs := report.BlockSizes[0]; bs.ChangedBytesPerSnapshot != bs.FullSnapshotBytes {
+		test.Errorf("Expected every snapshot to be full. Full: %f, changed: %f", bs.FullSnapshotBytes,
+			bs.ChangedBytesPerSnapshot)
+	}
+	buf.Reset()
+	if err := report.WriteText(&buf); err != nil {
+		test.Fatalf("Failed to write report. Err: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Assuming no blocks are reused") {
+		test.Errorf("Report is missing that dedup was not measured:\n%s", buf.String())
+	}
+
+	// a last iteration missing its block stats leaves the report to the one before
+	failed := &IterationStats{Iteration: 3, SizeStats: &SizeStats{FileSize: 200 * bytesPerGB},
+		Missing: []string{ComponentBlocks}}
+	report, err = NewStorageReport(append(results, failed), 6*time.Hour, sched)
+	if err != nil {
+		test.Fatalf("Failed to create report. Err: %v", err)
+	}
+	if full := report.BlockSizes[0].FullSnapshotBytes; full != 25*bytesPerGB {
+		test.Errorf("Expected the full snapshot of iteration 2. Received %f bytes", full)
+	}
+	if _, err = NewStorageReport([]*IterationStats{failed}, 6*time.Hour, sched); err == nil {
+		test.Errorf("Expected error without block stats")
+	}
+}
+
+func TestClusterStorageReport(test *testing.T) {
+	sched := SnapshotSchedule{
+		Interval:          6 * time.Hour,
+		Retention:         day,
+		PointInTimeWindow: day,
+	}
+
+	// like Iterate in cluster mode: oplog and size stats summed over the shards, no block stats
+	results := make([]*IterationStats, 0)
+	for i := 0; i < 2; i++ {
+		results = append(results, &IterationStats{
+			Iteration:  i,
+			OplogStats: &OplogStats{CompressedGbPerDay: 2},
+			SizeStats:  &SizeStats{FileSize: 10 * bytesPerGB},
+			Shards: []*ShardStats{
+				{OplogStats: &OplogStats{CompressedGbPerDay: 1}, SizeStats: &SizeStats{FileSize: 5 * bytesPerGB}},
+				{OplogStats: &OplogStats{CompressedGbPerDay: 1}, SizeStats: &SizeStats{FileSize: 5 * bytesPerGB}},
+			},
+		})
+	}
+
+	report, err := NewStorageReport(results, 6*time.Hour, sched)
+	if err != nil {
+		test.Fatalf("Failed to create cluster report. Err: %v", err)
+	}
+	if report.BlocksMeasured || report.DedupMeasured || len(report.BlockSizes) != 1 {
+		test.Fatalf("Expected a single projection without block stats. Received %+v", report)
+	}
+	// 4 full uncompressed snapshots and a day of oplog
+	steady := report.BlockSizes[0].Projections[len(report.BlockSizes[0].Projections)-1]
+	if expected := float64((4*10 + 2) * bytesPerGB); math.Abs(steady.TotalBytes-expected) > 1 {
+		test.Errorf("Expected %f total bytes. Received %f", expected, steady.TotalBytes)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteText(&buf); err != nil {
+		test.Fatalf("Failed to write report. Err: %v", err)
+	}
+	if strings.Contains(buf.String(), "Recommended block size") || !strings.Contains(buf.String(), "sharded") {
+		test.Errorf("Expected a report without a block size recommendation:\n%s", buf.String())
+	}
+
+	if _, err := NewStorageReport([]*IterationStats{{Missing: []string{ComponentOplog, ComponentSize}}},
+		6*time.Hour, sched); err == nil {
+		test.Errorf("Expected error without size stats")
+	}
+}
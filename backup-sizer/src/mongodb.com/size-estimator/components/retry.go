@@ -0,0 +1,117 @@
+package components
+
+import (
+	"context"
+	"gopkg.in/mgo.v2"
+	"strings"
+	"time"
+)
+
+// RetryPolicy retries an operation up to Attempts times in total, doubling the wait between attempts
+// from InitialBackoff up to MaxBackoff.
+type RetryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// server error codes
+const (
+	unauthorizedCode = 13
+	authFailedCode   = 18
+)
+
+// DefaultRetryPolicy rides out a replica set election, which usually takes under 12 seconds.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	wait := policy.InitialBackoff
+	for i := 1; i < attempt && wait < policy.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > policy.MaxBackoff {
+		wait = policy.MaxBackoff
+	}
+	return wait
+}
+
+// PermanentError is an error that another attempt cannot fix, like a dbpath that belongs to another
+// member. Retry returns it straight away.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent marks err as one that Retry should not retry. It returns nil for a nil err.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*PermanentError); ok {
+		return err
+	}
+	return &PermanentError{err}
+}
+
+// keepPermanent returns wrapped, which describes err, as permanent if err was.
+func keepPermanent(err error, wrapped error) error {
+	if IsPermanent(err) {
+		return Permanent(wrapped)
+	}
+	return wrapped
+}
+
+// IsPermanent reports whether err was marked with Permanent, or is a failure to authenticate or an
+// authorization error from the server.
+func IsPermanent(err error) bool {
+	if _, ok := err.(*PermanentError); ok {
+		return true
+	}
+	if qerr, ok := err.(*mgo.QueryError); ok && (qerr.Code == unauthorizedCode || qerr.Code == authFailedCode) {
+		return true
+	}
+	// mgo returns login failures as plain errors, and they are often wrapped in another message
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"auth fail", "authentication failed", "not authorized"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry calls fn until it succeeds, the attempts run out or ctx is done, and returns fn's last error.
+// Errors that another attempt cannot fix, like a missing oplog or a permanent error, are returned
+// straight away.
+func Retry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !retryable(err) || attempt >= policy.Attempts {
+			return err
+		}
+
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func retryable(err error) bool {
+	switch err {
+	case context.Canceled, context.DeadlineExceeded, OplogNotFoundError:
+		return false
+	}
+	return !IsPermanent(err)
+}
@@ -0,0 +1,109 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/mgo.v2"
+	"testing"
+	"time"
+)
+
+func TestRetry(test *testing.T) {
+	policy := RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	transient := errors.New("not master")
+
+	calls := 0
+	err := Retry(context.Background(), policy, func() error {
+		calls++
+		if calls < 3 {
+			return transient
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		test.Errorf("Expected success on the third attempt. Received %d attempts. Err: %v", calls, err)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), policy, func() error {
+		calls++
+		return transient
+	})
+	if err != transient || calls != 3 {
+		test.Errorf("Expected %v after 3 attempts. Received %v after %d", transient, err, calls)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), policy, func() error {
+		calls++
+		return OplogNotFoundError
+	})
+	if err != OplogNotFoundError || calls != 1 {
+		test.Errorf("Expected a missing oplog not to be retried. Received %v after %d attempts", err, calls)
+	}
+
+	// the zero policy makes a single attempt
+	calls = 0
+	Retry(context.Background(), RetryPolicy{}, func() error {
+		calls++
+		return transient
+	})
+	if calls != 1 {
+		test.Errorf("Expected a single attempt without a policy. Received %d", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	start := time.Now()
+	err = Retry(ctx, RetryPolicy{Attempts: 10, InitialBackoff: time.Hour, MaxBackoff: time.Hour}, func() error {
+		calls++
+		cancel()
+		return transient
+	})
+	if err != transient || calls != 1 || time.Since(start) > time.Second {
+		test.Errorf("Expected to stop waiting when cancelled. Received %v after %d attempts", err, calls)
+	}
+}
+
+func TestRetryBackoff(test *testing.T) {
+	policy := RetryPolicy{Attempts: 10, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, wait := range expected {
+		if backoff := policy.backoff(i + 1); backoff != wait {
+			test.Errorf("Expected to wait %v before attempt %d. Received %v", wait, i+2, backoff)
+		}
+	}
+}
+
+func TestPermanentErrors(test *testing.T) {
+	policy := RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	wrapped := errors.New("Failed to dial MongoDB on port localhost. Err server returned error on SASL " +
+		"authentication step: Authentication failed.")
+	var uncapped oplogCollStatsResult
+	uncapped.Capped = new(bool)
+	_, notCapped := uncapped.size()
+	_, badVersion := (&buildInfoResult{Version: "four"}).version()
+
+	for _, err := range []error{
+		Permanent(errors.New("mongod.lock is held by pid 1, not 2")),
+		&mgo.QueryError{Code: unauthorizedCode, Message: "not authorized on admin to execute command"},
+		wrapped,
+		notCapped,
+		badVersion,
+		keepPermanent(badVersion, errors.New("Failed to get directory path")),
+	} {
+		calls := 0
+		Retry(context.Background(), policy, func() error {
+			calls++
+			return err
+		})
+		if calls != 1 {
+			test.Errorf("Expected %v not to be retried. Received %d attempts", err, calls)
+		}
+	}
+
+	if Permanent(nil) != nil || IsPermanent(errors.New("not master")) ||
+		IsPermanent(keepPermanent(errors.New("no reachable servers"), errors.New("Failed to dial"))) {
+		test.Errorf("Expected transient errors not to be permanent")
+	}
+}
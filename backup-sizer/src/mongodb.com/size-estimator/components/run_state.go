@@ -0,0 +1,143 @@
+package components
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+const runStateFile = "run.json"
+
+// RunState is persisted alongside the hashes after every iteration so an interrupted run can be
+// resumed.
+type RunState struct {
+	Uri          string
+	Offline      bool
+	DbPath       string // absolute, offline runs only
+	SleepTime    time.Duration
+	NumIter      int
+	FalsePosRate float64
+	DedupMode    DedupMode
+	DedupWindow  int
+	DigestSize   int // bytes of each hash kept in the hash files
+	Chunking     ChunkParams
+	BlockSizes   []int
+	Schedule     SnapshotSchedule
+	Results      []*IterationStats
+}
+
+func NewRunState(opts *BackupSizingOpts, blocksizes []int) *RunState {
+	return &RunState{
+		Uri:          opts.SafeUri(),
+		Offline:      opts.Offline,
+		DbPath:       opts.offlineDbPath(),
+		SleepTime:    opts.SleepTime,
+		NumIter:      opts.NumIter,
+		FalsePosRate: opts.FalsePosRate,
+		DedupMode:    opts.DedupMode,
+		DedupWindow:  opts.DedupWindow,
+		DigestSize:   opts.digestSize(),
+		Chunking:     opts.Chunking,
+		BlockSizes:   blocksizes,
+		Schedule:     opts.Schedule,
+		Results:      make([]*IterationStats, 0),
+	}
+}
+
+// offlineDbPath identifies the data directory of an offline run, which all have the same uri.
+func (opts *BackupSizingOpts) offlineDbPath() string {
+	if !opts.Offline {
+		return ""
+	}
+	dbpath, err := filepath.Abs(opts.DbPath)
+	if err != nil {
+		return filepath.Clean(opts.DbPath)
+	}
+	return dbpath
+}
+
+// LoadRunState returns nil if hashDir holds no saved run.
+func LoadRunState(hashDir string) (*RunState, error) {
+	fn := filepath.Join(hashDir, runStateFile)
+	exists, err := CheckExists(fn)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	state := &RunState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("Failed to parse run state %s. Err: %v", fn, err)
+	}
+	for i, res := range state.Results {
+		if res == nil || res.Iteration != i {
+			return nil, fmt.Errorf("Run state %s is missing results for iteration %d", fn, i)
+		}
+	}
+	return state, nil
+}
+
+// Save writes to a temporary file first, so a crash while saving leaves the previous state intact.
+func (state *RunState) Save(hashDir string) error {
+	if err := os.MkdirAll(hashDir, 0777); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fn := filepath.Join(hashDir, runStateFile)
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// NextIteration is the first iteration that has not completed.
+func (state *RunState) NextIteration() int {
+	return len(state.Results)
+}
+
+// CheckCompatible returns an error if the saved run cannot be continued with the given options. The
+// number of iterations and the interval may change between runs.
+func (state *RunState) CheckCompatible(opts *BackupSizingOpts, blocksizes []int) error {
+	if state.Uri != opts.SafeUri() {
+		return fmt.Errorf("Saved run was against %s, not %s", state.Uri, opts.SafeUri())
+	}
+	if state.Offline != opts.Offline {
+		return fmt.Errorf("Saved run had offline %v, not %v", state.Offline, opts.Offline)
+	}
+	if state.DbPath != opts.offlineDbPath() {
+		return fmt.Errorf("Saved run analyzed %s, not %s", state.DbPath, opts.offlineDbPath())
+	}
+	if !reflect.DeepEqual(state.BlockSizes, blocksizes) {
+		return fmt.Errorf("Saved run used block sizes %v, not %v", state.BlockSizes, blocksizes)
+	}
+	if state.DedupMode != "" && state.DedupMode != opts.DedupMode {
+		return fmt.Errorf("Saved run used dedup mode %s, not %s", state.DedupMode, opts.DedupMode)
+	}
+	if state.DedupWindow != opts.DedupWindow {
+		return fmt.Errorf("Saved run used a dedup window of %d, not %d", state.DedupWindow, opts.DedupWindow)
+	}
+	// the hash files of the saved iterations can't be read with another digest size
+	if state.DigestSize != opts.digestSize() {
+		return fmt.Errorf("Saved run kept %d byte hashes, not %d", state.DigestSize, opts.digestSize())
+	}
+	if state.Chunking != opts.Chunking {
+		return fmt.Errorf("Saved run used chunk sizes %+v, not %+v", state.Chunking, opts.Chunking)
+	}
+	if state.NextIteration() >= opts.NumIter {
+		return fmt.Errorf("Saved run already completed %d of %d iterations", state.NextIteration(),
+			opts.NumIter)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package components
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRunState(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "runstate")
+	defer cleanupDir()
+
+	state, err := LoadRunState(dir)
+	if err != nil || state != nil {
+		test.Fatalf("Expected no saved state in empty directory. Received %v, err: %v", state, err)
+	}
+
+	opts := BackupSizingOpts{
+		Uri:          "localhost:27017",
+		SleepTime:    time.Hour,
+		NumIter:      3,
+		FalsePosRate: 0.01,
+		Schedule:     DefaultSnapshotSchedule,
+	}
+	sizes := []int{64 * kb, mb}
+
+	state = NewRunState(&opts, sizes)
+	state.Results = append(state.Results, &IterationStats{
+		Iteration:  0,
+		Start:      time.Now(),
+		OplogStats: &OplogStats{CompressionRatio: math.NaN(), GbPerDay: 1.5},
+		SizeStats:  &SizeStats{FileSize: 1024},
+		BlockStats: &AllBlockSizeStats{64 * kb: &BlockStats{DedupRate: 0.5}, mb: &BlockStats{}},
+	})
+	if err := state.Save(dir); err != nil {
+		test.Fatalf("Failed to save run state. Err: %v", err)
+	}
+
+	loaded, err := LoadRunState(dir)
+	if err != nil {
+		test.Fatalf("Failed to load run state. Err: %v", err)
+	}
+	if loaded.NextIteration() != 1 {
+		test.Errorf("Expected next iteration 1. Received %d", loaded.NextIteration())
+	}
+	res := loaded.Results[0]
+	if res.OplogStats.GbPerDay != 1.5 || (*res.BlockStats)[64*kb].DedupRate != 0.5 {
+		test.Errorf("Saved results did not round trip. Received %+v", res)
+	}
+	if err := loaded.CheckCompatible(&opts, sizes); err != nil {
+		test.Errorf("Unexpected error checking saved run. Err: %v", err)
+	}
+	if err := loaded.CheckCompatible(&opts, []int{64 * kb}); err == nil {
+		test.Errorf("Expected error for different block sizes")
+	}
+	for desc, change := range map[string]func(o *BackupSizingOpts){
+		"digest size":  func(o *BackupSizingOpts) { o.DigestSize = 16 },
+		"dedup window": func(o *BackupSizingOpts) { o.DedupWindow = 2 },
+		"chunk sizes":  func(o *BackupSizingOpts) { o.Chunking = NewChunkParams(0, 16*kb, 0) },
+	} {
+		other := opts
+		change(&other)
+		if err := loaded.CheckCompatible(&other, sizes); err == nil {
+			test.Errorf("Expected error for a different %s", desc)
+		}
+	}
+	opts.NumIter = 1
+	if err := loaded.CheckCompatible(&opts, sizes); err == nil {
+		test.Errorf("Expected error resuming a completed run")
+	}
+
+	// every offline run has the same uri, so the dbpath tells them apart
+	offline := BackupSizingOpts{Offline: true, DbPath: "data/a", NumIter: 3}
+	state = NewRunState(&offline, sizes)
+	if err := state.CheckCompatible(&offline, sizes); err != nil {
+		test.Errorf("Unexpected error checking saved offline run. Err: %v", err)
+	}
+	for _, other := range []BackupSizingOpts{
+		{Offline: true, DbPath: "data/b", NumIter: 3},
+		{DbPath: "data/a", NumIter: 3},
+	} {
+		if err := state.CheckCompatible(&other, sizes); err == nil {
+			test.Errorf("Expected error resuming an offline run of %s with %+v", offline.DbPath, other)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package components
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"strings"
+)
+
+// ServerVersion is the major.minor.patch version of a mongod, without any -rc0 or -pre- suffix.
+type ServerVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func ParseServerVersion(s string) (ServerVersion, error) {
+	core := s
+	if i := strings.IndexAny(core, "-+ "); i >= 0 {
+		core = core[:i]
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ServerVersion{}, fmt.Errorf("Failed to parse server version %q", s)
+	}
+
+	nums := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return ServerVersion{}, fmt.Errorf("Failed to parse server version %q", s)
+		}
+		nums[i] = n
+	}
+	return ServerVersion{nums[0], nums[1], nums[2]}, nil
+}
+
+func (v ServerVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast reports whether v is major.minor or newer.
+func (v ServerVersion) AtLeast(major, minor int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	return v.Minor >= minor
+}
+
+func getMongodVersion(session *mgo.Session) (ServerVersion, error) {
+	var result buildInfoResult
+	if err := session.DB("admin").Run(bson.D{{"buildInfo", 1}}, &result); err != nil {
+		return ServerVersion{}, fmt.Errorf("Failed to run buildInfo. Err: %v", err)
+	}
+	return result.version()
+}
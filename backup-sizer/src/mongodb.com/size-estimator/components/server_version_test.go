@@ -0,0 +1,45 @@
+package components
+
+import (
+	"testing"
+)
+
+func TestParseServerVersion(test *testing.T) {
+	for s, expected := range map[string]ServerVersion{
+		"2.6":            {2, 6, 0},
+		"3.0.15":         {3, 0, 15},
+		"3.10.2":         {3, 10, 2},
+		"4.2.0-rc0":      {4, 2, 0},
+		"4.4.0-rc13-2-g": {4, 4, 0},
+		"10.0.0":         {10, 0, 0},
+	} {
+		v, err := ParseServerVersion(s)
+		if err != nil || v != expected {
+			test.Errorf("Expected %s for %s. Received %s, err: %v", expected, s, v, err)
+		}
+	}
+	for _, s := range []string{"", "4", "4.x.1", "4.4.1.2", "-1.0"} {
+		if _, err := ParseServerVersion(s); err == nil {
+			test.Errorf("Expected error for version %q", s)
+		}
+	}
+}
+
+func TestServerVersionAtLeast(test *testing.T) {
+	cases := []struct {
+		version      ServerVersion
+		major, minor int
+		expected     bool
+	}{
+		{ServerVersion{2, 6, 12}, 3, 0, false},
+		{ServerVersion{3, 0, 0}, 3, 0, true},
+		{ServerVersion{3, 10, 0}, 3, 2, true},
+		{ServerVersion{3, 2, 22}, 3, 10, false},
+		{ServerVersion{10, 0, 0}, 4, 4, true},
+	}
+	for _, c := range cases {
+		if c.version.AtLeast(c.major, c.minor) != c.expected {
+			test.Errorf("Expected %s at least %d.%d to be %v", c.version, c.major, c.minor, c.expected)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package components
 
 import (
+	"context"
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"os"
@@ -42,40 +44,79 @@ func getWTFileSize(session *mgo.Session) (float64, error) {
 	return float64(fileSize), nil
 }
 
-func GetSizeStats(session *mgo.Session) (*SizeStats, error) {
-	dbs, err := session.DatabaseNames()
+// GetOfflineSizeStats only knows the size of the files in dbpath. Data and index sizes need dbStats.
+func GetOfflineSizeStats(dbpath string, storageEngine StorageEngine) (*SizeStats, error) {
+	fileSize, err := sumDirFiles(dbpath, storageEngine, true)
 	if err != nil {
 		return nil, err
 	}
+	return &SizeStats{FileSize: float64(fileSize)}, nil
+}
 
-	dataSize := float64(0)
-	fileSize := float64(0)
-	indexSize := float64(0)
+// GetSizeStats adds up dbStats of every database. WiredTiger doesn't report a file size, so the files in the
+// server's dbpath are summed instead, which have to be on this host.
+func GetSizeStats(ctx context.Context, session *mgo.Session) (*SizeStats, error) {
+	return getSizeStats(ctx, session, func() (float64, error) {
+		return getWTFileSize(session)
+	})
+}
 
-	fs := false
+// GetRemoteSizeStats is GetSizeStats for a server on another host, e.g. a shard, whose dbpath can't be
+// read. Without a file size from dbStats its file size is the storage and index sizes dbStats reports.
+func GetRemoteSizeStats(ctx context.Context, session *mgo.Session) (*SizeStats, error) {
+	return getSizeStats(ctx, session, nil)
+}
 
-	var results (bson.M)
-	for _, db := range dbs {
-		if err := session.DB(db).Run(bson.D{{"dbStats", 1}}, &results); err != nil {
+func getSizeStats(ctx context.Context, session *mgo.Session, localFileSize func() (float64, error)) (
+	*SizeStats, error) {
+	dbs, err := session.DatabaseNames()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]dbStatsResult, len(dbs))
+	for i, db := range dbs {
+		if err := ctx.Err(); err != nil {
 			return nil, err
 		}
-		dataSize += results["dataSize"].(float64)
-		indexSize += results["indexSize"].(float64)
-		v := results["fileSize"]
-		if v != nil {
-			fileSize += v.(float64)
-			fs = true
+		if err := session.DB(db).Run(bson.D{{"dbStats", 1}}, &results[i]); err != nil {
+			return nil, fmt.Errorf("Failed to run dbStats on %s. Err: %v", db, err)
 		}
 	}
+	return sumDbStats(dbs, results, localFileSize)
+}
 
-	if !fs {
-		fileSize, err = getWTFileSize(session)
+// sumDbStats falls back to localFileSize for the file size if the server doesn't report one, or to
+// the stored sizes if localFileSize is nil.
+func sumDbStats(dbs []string, results []dbStatsResult, localFileSize func() (float64, error)) (*SizeStats,
+	error) {
+	stats := &SizeStats{}
+	fs := false
+	for i := range results {
+		hasFileSize, err := results[i].addTo(stats)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Failed to read the stats of %s. Err: %v", dbs[i], err)
 		}
+		fs = fs || hasFileSize
+	}
+	if fs {
+		return stats, nil
 	}
 
-	return &SizeStats{
-		dataSize, indexSize, fileSize,
-	}, nil
+	if localFileSize != nil {
+		fileSize, err := localFileSize()
+		if err != nil {
+			return nil, err
+		}
+		stats.FileSize = fileSize
+		return stats, nil
+	}
+	for i := range results {
+		storedSize, err := results[i].storedSize()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the stats of %s. Err: %v", dbs[i], err)
+		}
+		stats.FileSize += storedSize
+	}
+	return stats, nil
 }
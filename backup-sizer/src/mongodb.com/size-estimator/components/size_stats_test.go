@@ -1,7 +1,10 @@
 package components
 
 import (
+	"context"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
 	"testing"
 )
 
@@ -42,14 +45,14 @@ func testCappedCollection(test *testing.T, port int) {
 	session.DB(dbName).DropDatabase()
 	session.DB(dbName).C("capped").Create(&mgo.CollectionInfo{Capped: true, MaxBytes: 4096})
 
-	sizes1, err := GetSizeStats(session)
+	sizes1, err := GetSizeStats(context.Background(), session)
 	if err != nil {
 		test.Errorf("Failed to get sizes on db with a capped collection. Err: %v", err)
 	}
 
 	insertDocuments(session, dbName, "capped", 4096)
 
-	sizes2, err := GetSizeStats(session)
+	sizes2, err := GetSizeStats(context.Background(), session)
 	if err != nil {
 		test.Errorf("Failed to get sizes on db with a capped collection. Err: %v", err)
 	}
@@ -67,14 +70,14 @@ func testSizeStats(test *testing.T, port int) {
 
 	session.DB(dbName).DropDatabase()
 
-	sizes1, err := GetSizeStats(session)
+	sizes1, err := GetSizeStats(context.Background(), session)
 	if err != nil {
 		test.Errorf("Failed to get sizes on port %i. Err %v", port, err)
 	}
 
 	insertDocuments(session, dbName, collName, 1000)
 
-	sizes2, err := GetSizeStats(session)
+	sizes2, err := GetSizeStats(context.Background(), session)
 	if err != nil {
 		test.Errorf("Failed to get sizes on port %i. Err %v", port, err)
 	}
@@ -94,7 +97,7 @@ func testSizeStats(test *testing.T, port int) {
 
 	removeDocuments(session, dbName, collName, 1000)
 
-	sizes3, err := GetSizeStats(session)
+	sizes3, err := GetSizeStats(context.Background(), session)
 	if err != nil {
 		test.Errorf("Failed to get sizes on port %i. Err %v", port, err)
 	}
@@ -105,7 +108,7 @@ func testSizeStats(test *testing.T, port int) {
 
 	// test multiple databases
 	generateBytes(session, "test2", collName, 5*1024*1024, bytesSame)
-	sizes4, err := GetSizeStats(session)
+	sizes4, err := GetSizeStats(context.Background(), session)
 	if err != nil {
 		test.Errorf("Failed to get sizes on port %i with multiple databases. Err %v", port, err)
 	}
@@ -125,3 +128,58 @@ func TestWTSizeStats(test *testing.T) {
 	testSizeStats(test, replset_wt_dirPerDb)
 	testCappedCollection(test, wt_port_defPath)
 }
+
+func TestOfflineSizeStats(test *testing.T) {
+	sizes, err := GetOfflineSizeStats(TestDataDir, mmap)
+	if err != nil {
+		test.Fatalf("Failed to get sizes for %s. Err: %v", TestDataDir, err)
+	}
+	// oneblock.test, partialblock.test and subdir/fiveblocksrandom.test
+	expected := float64(65536 + 328704 + 327680)
+	if sizes.FileSize != expected || sizes.DataSize != 0 {
+		test.Errorf("Expected file size %f and no data size. Received %+v", expected, sizes)
+	}
+}
+
+func TestRemoteSizeStats(test *testing.T) {
+	// a WiredTiger shard, whose dbpath is not on this host
+	dbs := []string{"admin", "test"}
+	results := make([]dbStatsResult, len(dbs))
+	for i, response := range []bson.M{
+		{"dataSize": 100, "storageSize": int64(4096), "indexSize": 4096},
+		{"dataSize": 1 << 20, "storageSize": 1 << 19, "indexSize": int64(1 << 16)},
+	} {
+		decodeResponse(test, response, &results[i])
+	}
+	localFileSize := func() (float64, error) {
+		size, err := sumDirFiles("./DoesNotExist", wiredTiger, true)
+		return float64(size), err
+	}
+
+	if _, err := sumDbStats(dbs, results, localFileSize); err == nil {
+		test.Errorf("Expected error summing the files of a dbpath that is not on this host")
+	}
+	stats, err := sumDbStats(dbs, results, nil)
+	if err != nil {
+		test.Fatalf("Failed to sum the stats of a remote shard. Err: %v", err)
+	}
+	expected := SizeStats{DataSize: 100 + 1<<20, IndexSize: 4096 + 1<<16, FileSize: 8192 + 1<<19 + 1<<16}
+	if *stats != expected {
+		test.Errorf("Expected %+v. Received %+v", expected, *stats)
+	}
+
+	// mmapv1 reports its file size, so no fallback is needed
+	var mmapResult dbStatsResult
+	decodeResponse(test, bson.M{"dataSize": 1, "storageSize": 2, "indexSize": 3, "fileSize": 1 << 24}, &mmapResult)
+	stats, err = sumDbStats([]string{"test"}, []dbStatsResult{mmapResult}, localFileSize)
+	if err != nil || stats.FileSize != 1<<24 {
+		test.Errorf("Expected file size %d. Received %+v, err: %v", 1<<24, stats, err)
+	}
+
+	var noStorageSize dbStatsResult
+	decodeResponse(test, bson.M{"dataSize": 1, "indexSize": 3}, &noStorageSize)
+	_, err = sumDbStats([]string{"test"}, []dbStatsResult{noStorageSize}, nil)
+	if err == nil || !strings.Contains(err.Error(), "storageSize") {
+		test.Errorf("Expected error naming storageSize. Received %v", err)
+	}
+}
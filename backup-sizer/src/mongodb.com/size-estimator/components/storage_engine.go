@@ -0,0 +1,109 @@
+package components
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var UnknownStorageLayoutError = errors.New("Could not find WiredTiger or mmapv1 files in the data directory.")
+
+// wiredTiger always creates these at the top of the dbpath
+var wiredTigerMarkers = []string{"WiredTiger", "WiredTiger.wt"}
+
+// DetectStorageEngine inspects the files in dbpath. storage.bson, written by 3.0 and later, names the
+// engine and must agree with the files found.
+func DetectStorageEngine(dbpath string) (StorageEngine, error) {
+	hasWT := false
+	for _, marker := range wiredTigerMarkers {
+		exists, err := CheckExists(filepath.Join(dbpath, marker))
+		if err != nil {
+			return "", err
+		}
+		hasWT = hasWT || exists
+	}
+
+	hasMmap, err := hasNamespaceFiles(dbpath, true)
+	if err != nil {
+		return "", err
+	}
+
+	if hasWT && hasMmap {
+		return "", fmt.Errorf("Found both WiredTiger and mmapv1 (.ns) files in %s", dbpath)
+	}
+
+	var found StorageEngine
+	switch {
+	case hasWT:
+		found = wiredTiger
+	case hasMmap:
+		found = mmap
+	}
+
+	named, err := readStorageBson(dbpath)
+	if err != nil {
+		return "", err
+	}
+	if named != "" {
+		se, err := ParseStorageEngine(named)
+		if err != nil {
+			return "", fmt.Errorf("storage.bson in %s: %v", dbpath, err)
+		}
+		if found != "" && found != se {
+			return "", fmt.Errorf("storage.bson in %s names %s but the directory holds %s files", dbpath, se, found)
+		}
+		return se, nil
+	}
+
+	if found == "" {
+		return "", UnknownStorageLayoutError
+	}
+	return found, nil
+}
+
+// mmapv1 keeps a <db>.ns file per database, one directory down with --directoryperdb
+func hasNamespaceFiles(dir string, crawlFurther bool) (bool, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range fileInfos {
+		if fi.IsDir() && crawlFurther {
+			found, err := hasNamespaceFiles(filepath.Join(dir, fi.Name()), false)
+			if err != nil {
+				return false, err
+			}
+			if found {
+				return true, nil
+			}
+		} else if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".ns") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readStorageBson returns the engine named in storage.bson, or "" if there is no storage.bson.
+func readStorageBson(dbpath string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dbpath, "storage.bson"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	var doc struct {
+		Storage struct {
+			Engine string `bson:"engine"`
+		} `bson:"storage"`
+	}
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		return "", fmt.Errorf("Failed to parse storage.bson in %s. Err: %v", dbpath, err)
+	}
+	return doc.Storage.Engine, nil
+}
@@ -0,0 +1,111 @@
+package components
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeDbPath(test *testing.T, files map[string][]byte) string {
+	dir, err := ioutil.TempDir("", "dbpath")
+	if err != nil {
+		test.Fatalf("Failed to create temp dir. Err: %v", err)
+	}
+	for name, contents := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+			test.Fatalf("Failed to create %s. Err: %v", filepath.Dir(fn), err)
+		}
+		if err := ioutil.WriteFile(fn, contents, 0666); err != nil {
+			test.Fatalf("Failed to write %s. Err: %v", fn, err)
+		}
+	}
+	return dir
+}
+
+func storageBson(test *testing.T, engine string) []byte {
+	b, err := bson.Marshal(bson.M{"storage": bson.M{"engine": engine}})
+	if err != nil {
+		test.Fatalf("Failed to marshal storage.bson. Err: %v", err)
+	}
+	return b
+}
+
+func TestDetectStorageEngine(test *testing.T) {
+	testCases := []struct {
+		files    map[string][]byte
+		expected StorageEngine
+		desc     string
+	}{
+		{map[string][]byte{"WiredTiger": nil, "WiredTiger.wt": nil, "collection-0-1.wt": nil},
+			wiredTiger, "wiredTiger"},
+		{map[string][]byte{"WiredTiger": nil, "storage.bson": storageBson(test, "wiredTiger")},
+			wiredTiger, "wiredTiger with storage.bson"},
+		{map[string][]byte{"test.ns": nil, "test.0": nil, "local.ns": nil}, mmap, "mmapv1"},
+		{map[string][]byte{"test/test.ns": nil, "test/test.0": nil}, mmap, "mmapv1 with directoryperdb"},
+		{map[string][]byte{"storage.bson": storageBson(test, "mmapv1")}, mmap, "storage.bson only"},
+	}
+	for _, testCase := range testCases {
+		dir := makeDbPath(test, testCase.files)
+		se, err := DetectStorageEngine(dir)
+		if err != nil {
+			test.Errorf("Testing %s, unexpected error. Err: %v", testCase.desc, err)
+		} else if se != testCase.expected {
+			test.Errorf("Testing %s, expected %s. Received %s", testCase.desc, testCase.expected, se)
+		}
+		os.RemoveAll(dir)
+	}
+
+	badCases := []struct {
+		files map[string][]byte
+		desc  string
+	}{
+		{map[string][]byte{"WiredTiger.wt": nil, "test.ns": nil}, "mixed files"},
+		{map[string][]byte{"WiredTiger": nil, "storage.bson": storageBson(test, "mmapv1")},
+			"storage.bson disagrees with files"},
+		{map[string][]byte{"storage.bson": storageBson(test, "inMemory")}, "unknown engine in storage.bson"},
+		{map[string][]byte{"storage.bson": []byte("not bson")}, "corrupt storage.bson"},
+		{map[string][]byte{"data.0": nil}, "no recognizable files"},
+	}
+	for _, testCase := range badCases {
+		dir := makeDbPath(test, testCase.files)
+		se, err := DetectStorageEngine(dir)
+		if err == nil {
+			test.Errorf("Testing %s, expected error. Received %s", testCase.desc, se)
+		}
+		os.RemoveAll(dir)
+	}
+
+	if _, err := DetectStorageEngine("./DoesNotExist"); err == nil {
+		test.Errorf("Expected error for nonexistent directory")
+	}
+}
+
+func TestGetStorageEngineOffline(test *testing.T) {
+	cases := []struct {
+		files    map[string][]byte
+		given    StorageEngine
+		expected StorageEngine // "" if an error is expected
+		desc     string
+	}{
+		{map[string][]byte{"WiredTiger": nil}, "", wiredTiger, "detected"},
+		{map[string][]byte{"WiredTiger": nil}, wiredTiger, wiredTiger, "given and detected"},
+		{map[string][]byte{"data.0": nil}, mmap, mmap, "given, nothing detected"},
+		{map[string][]byte{"WiredTiger": nil}, mmap, "", "given, other engine detected"},
+		{map[string][]byte{"WiredTiger.wt": nil, "test.ns": nil}, wiredTiger, "", "given, mixed files"},
+		{map[string][]byte{"storage.bson": []byte("not bson")}, mmap, "", "given, corrupt storage.bson"},
+	}
+	for _, testCase := range cases {
+		dir := makeDbPath(test, testCase.files)
+		opts := BackupSizingOpts{Offline: true, DbPath: dir, StorageEngine: testCase.given}
+		se, err := opts.GetStorageEngine()
+		if testCase.expected == "" && err == nil {
+			test.Errorf("Testing %s, expected error. Received %s", testCase.desc, se)
+		} else if testCase.expected != "" && (err != nil || se != testCase.expected) {
+			test.Errorf("Testing %s, expected %s. Received %s, err: %v", testCase.desc, testCase.expected, se, err)
+		}
+		os.RemoveAll(dir)
+	}
+}
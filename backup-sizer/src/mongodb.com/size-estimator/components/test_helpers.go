@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
 	"strconv"
 )
 
@@ -27,6 +29,31 @@ func dial(port int) *mgo.Session {
 	return session
 }
 
+// fataler is the part of *testing.T used here. This file is built into the package, so it doesn't import
+// testing.
+type fataler interface {
+	Fatalf(format string, args ...interface{})
+}
+
+// tempDir creates a temporary directory for a test. cleanup removes it.
+func tempDir(test fataler, prefix string) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		test.Fatalf("Failed to create temp dir. Err: %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// tempDirs creates the data and hash directories of an offline run. cleanup removes both.
+func tempDirs(test fataler) (dataDir, hashDir string, cleanup func()) {
+	dataDir, cleanupData := tempDir(test, "data")
+	hashDir, cleanupHashes := tempDir(test, "hashes")
+	return dataDir, hashDir, func() {
+		cleanupHashes()
+		cleanupData()
+	}
+}
+
 func insertDocuments(mongo *mgo.Session, database string, collection string, numInsert int) {
 	session := mongo.Clone()
 	defer session.Close()
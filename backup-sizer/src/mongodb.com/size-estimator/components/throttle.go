@@ -0,0 +1,87 @@
+package components
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Throttle caps the rate of reads shared by several goroutines. A nil Throttle doesn't limit anything.
+type Throttle struct {
+	mu          sync.Mutex
+	bytesPerSec float64
+	next        time.Time // when the next read may start
+}
+
+// NewThrottle is nil if mbPerSec is not positive.
+func NewThrottle(mbPerSec float64) *Throttle {
+	if mbPerSec <= 0 {
+		return nil
+	}
+	return &Throttle{bytesPerSec: mbPerSec * 1024 * 1024}
+}
+
+// Wait reserves n bytes, and sleeps until reading them fits in the rate. Every read waits for the
+// time its bytes take at the rate, so even the first one after an idle period doesn't burst past it.
+// It returns ctx's error if ctx is done first.
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+	if t == nil || n <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(t.duration(n))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// giveBack returns the part of a reservation that wasn't read, e.g. at the end of a file.
+func (t *Throttle) giveBack(n int) {
+	if n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	t.next = t.next.Add(-t.duration(n))
+	t.mu.Unlock()
+}
+
+func (t *Throttle) duration(n int) time.Duration {
+	return time.Duration(float64(n) / t.bytesPerSec * float64(time.Second))
+}
+
+// Reader throttles reads from r. Reads fail with ctx's error once it is done.
+func (t *Throttle) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{ctx, r, t}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *Throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if err := tr.t.Wait(tr.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := tr.r.Read(p)
+	tr.t.giveBack(len(p) - n)
+	return n, err
+}
@@ -0,0 +1,73 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottle(test *testing.T) {
+	if NewThrottle(0) != nil {
+		test.Errorf("Expected no throttle without a rate")
+	}
+	r := bytes.NewReader(nil)
+	var unlimited *Throttle
+	if unlimited.Reader(context.Background(), r) != io.Reader(r) {
+		test.Errorf("Expected a nil throttle not to wrap readers")
+	}
+	if err := unlimited.Wait(context.Background(), mb); err != nil {
+		test.Errorf("Expected a nil throttle not to wait. Received %v", err)
+	}
+
+	// 4mb at 16mb/s, shared by two readers
+	throttle := NewThrottle(16)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(ioutil.Discard, throttle.Reader(context.Background(), bytes.NewReader(make([]byte, 2*mb))))
+			if err != nil || n != 2*mb {
+				test.Errorf("Expected to read %d bytes. Received %d. Err: %v", 2*mb, n, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		test.Errorf("Expected reading 4mb at 16mb/s to take about 250ms. Received %v", elapsed)
+	}
+}
+
+func TestThrottleFirstRead(test *testing.T) {
+	// the first read is not free: 1mb at 16mb/s takes about 62ms
+	throttle := NewThrottle(16)
+	start := time.Now()
+	b := make([]byte, mb)
+	if _, err := io.ReadFull(throttle.Reader(context.Background(), bytes.NewReader(b)), b); err != nil {
+		test.Fatalf("Failed to read. Err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		test.Errorf("Expected the first read to wait for the rate. Received %v", elapsed)
+	}
+}
+
+func TestThrottleCancel(test *testing.T) {
+	// 4mb at 1mb/s would take about 4s
+	throttle := NewThrottle(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := io.Copy(ioutil.Discard, throttle.Reader(ctx, bytes.NewReader(make([]byte, 4*mb))))
+	if err != context.DeadlineExceeded {
+		test.Errorf("Expected %v. Received %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		test.Errorf("Expected the read to stop soon after ctx is done. Received %v", elapsed)
+	}
+}
@@ -0,0 +1,124 @@
+package components
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TLSEnabled is true if any of the ssl options are set.
+func (opts BackupSizingOpts) TLSEnabled() bool {
+	return opts.SSL || opts.SSLCAFile != "" || opts.SSLPEMKeyFile != "" ||
+		opts.SSLAllowInvalidCertificates || opts.SSLAllowInvalidHostnames
+}
+
+func (opts BackupSizingOpts) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if opts.SSLCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.SSLCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA file %s. Err: %v", opts.SSLCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", opts.SSLCAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.SSLPEMKeyFile != "" {
+		// mongod expects the certificate and key in the same file
+		cert, err := tls.LoadX509KeyPair(opts.SSLPEMKeyFile, opts.SSLPEMKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load PEM key file %s. Err: %v", opts.SSLPEMKeyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case opts.SSLAllowInvalidCertificates:
+		config.InsecureSkipVerify = true
+	case opts.SSLAllowInvalidHostnames:
+		// skip the default verification, which always checks the hostname, and verify the chain ourselves
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, config.RootCAs)
+		}
+	}
+	return config, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("Server did not present a certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+func dialTLS(addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
+
+// x509Username is the subject of the client certificate, which is the user name for MONGODB-X509.
+func x509Username(config *tls.Config) (string, error) {
+	if len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return "", fmt.Errorf("Authentication mechanism %s requires a client certificate", AuthX509)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return cert.Subject.String(), nil
+}
+
+// removeTLSOptions strips the ssl and tls options, which mgo does not understand, from a connection
+// string and reports whether either enabled TLS.
+func removeTLSOptions(uri string) (string, bool, error) {
+	queryStart := strings.Index(uri, "?")
+	if queryStart < 0 {
+		return uri, false, nil
+	}
+	query, err := url.ParseQuery(uri[queryStart+1:])
+	if err != nil {
+		return "", false, err
+	}
+
+	enabled := false
+	for _, key := range []string{"ssl", "tls"} {
+		if v := query.Get(key); v != "" {
+			enabled = enabled || v == "true"
+			query.Del(key)
+		}
+	}
+
+	uri = uri[:queryStart]
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	return uri, enabled, nil
+}
@@ -0,0 +1,195 @@
+package components
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	pemFile string // certificate followed by key, the way mongod expects it
+}
+
+func newTestCert(test *testing.T, dir string, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		test.Fatalf("Failed to generate key. Err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"size-estimator"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if !isCA {
+		template.DNSNames = []string{name}
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		test.Fatalf("Failed to create certificate. Err: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		test.Fatalf("Failed to parse certificate. Err: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		test.Fatalf("Failed to marshal key. Err: %v", err)
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pemBytes = append(pemBytes, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	pemFile := filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(pemFile, pemBytes, 0600); err != nil {
+		test.Fatalf("Failed to write %s. Err: %v", pemFile, err)
+	}
+	return &testCert{cert, key, pemFile}
+}
+
+// startTLSListener accepts connections and completes the handshake until the listener is closed.
+func startTLSListener(test *testing.T, server *testCert, clientCAs *x509.CertPool) net.Listener {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{server.cert.Raw},
+			PrivateKey:  server.key,
+		}},
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		test.Fatalf("Failed to listen. Err: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestTLSDial(test *testing.T) {
+	dir, cleanupDir := tempDir(test, "tls")
+	defer cleanupDir()
+
+	ca := newTestCert(test, dir, "ca", nil, true)
+	server := newTestCert(test, dir, "localhost", ca, false)
+	client := newTestCert(test, dir, "client", ca, false)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	l := startTLSListener(test, server, clientCAs)
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	testCases := []struct {
+		opts    BackupSizingOpts
+		addr    string
+		success bool
+		desc    string
+	}{
+		{BackupSizingOpts{SSLCAFile: ca.pemFile, SSLPEMKeyFile: client.pemFile},
+			"localhost:" + port, true, "trusted CA and matching hostname"},
+		{BackupSizingOpts{SSLCAFile: ca.pemFile, SSLPEMKeyFile: client.pemFile},
+			"127.0.0.1:" + port, false, "hostname does not match certificate"},
+		{BackupSizingOpts{SSLCAFile: ca.pemFile, SSLPEMKeyFile: client.pemFile, SSLAllowInvalidHostnames: true},
+			"127.0.0.1:" + port, true, "invalid hostnames allowed"},
+		{BackupSizingOpts{SSLPEMKeyFile: client.pemFile, SSLAllowInvalidHostnames: true},
+			"127.0.0.1:" + port, false, "unknown CA with invalid hostnames allowed"},
+		{BackupSizingOpts{SSLPEMKeyFile: client.pemFile},
+			"localhost:" + port, false, "unknown CA"},
+		{BackupSizingOpts{SSLPEMKeyFile: client.pemFile, SSLAllowInvalidCertificates: true},
+			"127.0.0.1:" + port, true, "invalid certificates allowed"},
+	}
+
+	for _, testCase := range testCases {
+		config, err := testCase.opts.TLSConfig()
+		if err != nil {
+			test.Fatalf("Failed to build TLS config for %s. Err: %v", testCase.desc, err)
+		}
+		conn, err := dialTLS(testCase.addr, config, 5*time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		if testCase.success && err != nil {
+			test.Errorf("Testing %s, unexpected error dialing %s. Err: %v", testCase.desc, testCase.addr, err)
+		}
+		if !testCase.success && err == nil {
+			test.Errorf("Testing %s, expected error dialing %s", testCase.desc, testCase.addr)
+		}
+	}
+
+	// the x.509 user name comes from the client certificate
+	opts := BackupSizingOpts{
+		Uri:           "mongodb://localhost:" + port + "/?ssl=true",
+		SSLCAFile:     ca.pemFile,
+		SSLPEMKeyFile: client.pemFile,
+		AuthMechanism: AuthX509,
+	}
+	info, err := opts.DialInfo()
+	if err != nil {
+		test.Fatalf("Failed to get dial info. Err: %v", err)
+	}
+	if info.DialServer == nil {
+		test.Errorf("Expected a TLS dialer")
+	}
+	if info.Username != "CN=client,O=size-estimator" {
+		test.Errorf("Expected user name from client certificate. Received %s", info.Username)
+	}
+
+	if _, err := (BackupSizingOpts{SSLCAFile: server.pemFile + ".missing"}).TLSConfig(); err == nil {
+		test.Errorf("Expected error for missing CA file")
+	}
+}
+
+func TestRemoveTLSOptions(test *testing.T) {
+	testCases := []struct {
+		uri      string
+		expected string
+		enabled  bool
+	}{
+		{"localhost:27017", "localhost:27017", false},
+		{"mongodb://a,b/?ssl=true", "mongodb://a,b/", true},
+		{"mongodb://a/?tls=false&replicaSet=rs", "mongodb://a/?replicaSet=rs", false},
+	}
+	for _, testCase := range testCases {
+		uri, enabled, err := removeTLSOptions(testCase.uri)
+		if err != nil {
+			test.Errorf("Unexpected error for %s. Err: %v", testCase.uri, err)
+		}
+		if uri != testCase.expected || enabled != testCase.enabled {
+			test.Errorf("Expected (%s, %v) for %s. Received (%s, %v)", testCase.expected, testCase.enabled,
+				testCase.uri, uri, enabled)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
+	. "mongodb.com/size-estimator/components"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	OutputCSV    = "csv"
+	OutputJSON   = "json"
+	OutputNDJSON = "ndjson"
+)
+
+// OutputWriter emits one record per iteration, followed by the storage report, in a machine
+// readable format.
+type OutputWriter interface {
+	WriteHeader() error
+	WriteIteration(stats *IterationStats) error
+	WriteReport(report *StorageReport) error
+	Close() error
+}
+
+// In cluster mode the csv output has a row per shard, followed by their total, in each iteration.
+// With an exact dedup mode it has the Bloom filter's estimate next to each measured dedup rate. Every
+// block compressor after the first gets its own compression rate columns. Content defined chunks get
+// columns after the fixed block sizes. A breakdown by file and database does not fit the rows, so each
+// iteration's is written to its own files in hashDir/breakdown.
+func NewOutputWriter(opts *BackupSizingOpts, w io.Writer) (OutputWriter, error) {
+	switch format := opts.Output; format {
+	case OutputCSV:
+		bloomRates := opts.DedupMode != "" && opts.DedupMode != DedupBloom
+		codecs := make([]string, 0)
+		for i := 1; i < len(opts.BlockCompressors); i++ {
+			codecs = append(codecs, opts.BlockCompressors[i].Name())
+		}
+		cw := &csvWriter{
+			w:          w,
+			cluster:    opts.Cluster,
+			bloomRates: bloomRates,
+			codecs:     codecs,
+			chunkAvg:   opts.Chunking.Avg,
+		}
+		if opts.Breakdown {
+			cw.breakdownDir = filepath.Join(opts.HashDir, "breakdown")
+		}
+		return cw, nil
+	case OutputJSON:
+		return &jsonWriter{w: w, document: true}, nil
+	case OutputNDJSON:
+		return &jsonWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("Unknown output format %q. Expected one of %s, %s, %s",
+		opts.Output, OutputCSV, OutputJSON, OutputNDJSON)
+}
+
+// jsonWriter writes either a single JSON document holding every iteration and the final report
+// (json), or one compact record per line (ndjson).
+type jsonWriter struct {
+	w        io.Writer
+	document bool
+	written  int
+	reported bool
+}
+
+func (jw *jsonWriter) WriteHeader() error {
+	if !jw.document {
+		return nil
+	}
+	_, err := io.WriteString(jw.w, "{\n  \"Iterations\": [")
+	return err
+}
+
+func (jw *jsonWriter) WriteIteration(stats *IterationStats) error {
+	if !jw.document {
+		return jw.writeLine(stats)
+	}
+
+	sep := ",\n    "
+	if jw.written == 0 {
+		sep = "\n    "
+	}
+	jw.written++
+	return jw.writeIndented(sep, "    ", stats)
+}
+
+func (jw *jsonWriter) WriteReport(report *StorageReport) error {
+	if !jw.document {
+		return jw.writeLine(struct{ Report *StorageReport }{report})
+	}
+	jw.reported = true
+	return jw.writeIndented("\n  ],\n  \"Report\": ", "  ", report)
+}
+
+func (jw *jsonWriter) Close() error {
+	if !jw.document {
+		return nil
+	}
+	end := "\n}\n"
+	if !jw.reported {
+		end = "\n  ]" + end
+	}
+	_, err := io.WriteString(jw.w, end)
+	return err
+}
+
+func (jw *jsonWriter) writeLine(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = jw.w.Write(b)
+	return err
+}
+
+func (jw *jsonWriter) writeIndented(prefix string, indent string, v interface{}) error {
+	b, err := json.MarshalIndent(v, indent, "  ")
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(jw.w, prefix); err != nil {
+		return err
+	}
+	_, err = jw.w.Write(b)
+	return err
+}
+
+type csvWriter struct {
+	w          io.Writer
+	cluster    bool
+	bloomRates bool
+	codecs     []string // compressors after the first
+	chunkAvg   int      // 0 without content defined chunking
+
+	breakdownDir string // empty without a breakdown
+}
+
+const clusterTotalRow = "total"
+
+func (cw *csvWriter) WriteHeader() error {
+	allStats := []interface{}{
+		&OplogStats{},
+		&SizeStats{},
+	}
+
+	var buffer []byte
+	if cw.cluster {
+		buffer = append(buffer, "Shard,"...)
+	}
+	for _, stats := range allStats {
+
+		s := reflect.ValueOf(stats).Elem()
+
+		for i := 0; i < s.NumField(); i++ {
+			buffer = append(buffer, s.Type().Field(i).Name...)
+			buffer = append(buffer, ',')
+		}
+	}
+
+	// this is just going to have to be hardcoded for now.
+	for _, bs := range blocksizes {
+		buffer = append(buffer, fmt.Sprintf("DedupRate(%d),", bs)...)
+		if cw.bloomRates {
+			buffer = append(buffer, fmt.Sprintf("BloomDedupRate(%d),", bs)...)
+		}
+		buffer = append(buffer, fmt.Sprintf("IntraDedupRate(%d),DataCompressionRate(%d),", bs, bs)...)
+		for _, codec := range cw.codecs {
+			buffer = append(buffer, fmt.Sprintf("DataCompressionRate(%d %s),", bs, codec)...)
+		}
+		buffer = append(buffer, fmt.Sprintf("NewBlocks(%d),CompressedGbPerDay(%d),", bs, bs)...)
+	}
+	if cw.chunkAvg > 0 {
+		buffer = append(buffer, fmt.Sprintf("ChunkDedupRate(%d),ChunkIntraDedupRate(%d),ChunkCompressionRate(%d),",
+			cw.chunkAvg, cw.chunkAvg, cw.chunkAvg)...)
+	}
+	buffer = append(buffer, "Missing,"...)
+
+	buffer[len(buffer)-1] = '\n'
+	_, err := cw.w.Write(buffer)
+	return err
+}
+
+func (cw *csvWriter) WriteIteration(stats *IterationStats) error {
+	if stats.Breakdown != nil && cw.breakdownDir != "" {
+		if err := writeBreakdown(cw.breakdownDir, stats.Iteration, stats.Breakdown); err != nil {
+			return fmt.Errorf("Failed to write breakdown to %s. Err: %v", cw.breakdownDir, err)
+		}
+	}
+	if !cw.cluster {
+		return cw.writeRow(nil, stats.OplogStats, stats.SizeStats, stats.BlockStats, stats.ChunkStats,
+			stats.Missing)
+	}
+
+	for _, shard := range stats.Shards {
+		err := cw.writeRow([]byte(shard.Shard+","), shard.OplogStats, shard.SizeStats, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return cw.writeRow([]byte(clusterTotalRow+","), stats.OplogStats, stats.SizeStats, stats.BlockStats,
+		stats.ChunkStats, stats.Missing)
+}
+
+// writeRow ends with the components that are missing, separated by semicolons.
+func (cw *csvWriter) writeRow(buffer []byte, oplogStats *OplogStats, sizeStats *SizeStats,
+	blockStats *AllBlockSizeStats, chunkStats *BlockStats, missing []string) error {
+
+	allStats := []interface{}{
+		oplogStats,
+		sizeStats,
+	}
+	for _, stat := range allStats {
+		v := reflect.ValueOf(stat)
+		if v.IsNil() {
+			// not collected, e.g. when running offline. Leave the columns empty.
+			for i := 0; i < v.Type().Elem().NumField(); i++ {
+				buffer = append(buffer, ',')
+			}
+			continue
+		}
+		s := v.Elem()
+		for i := 0; i < s.NumField(); i++ {
+			f := s.Field(i)
+			val := f.Interface()
+			buffer = append(buffer, toString(val)...)
+			buffer = append(buffer, ',')
+		}
+	}
+
+	for _, size := range blocksizes {
+		if blockStats == nil {
+			buffer = append(buffer, ",,,,,"...)
+			if cw.bloomRates {
+				buffer = append(buffer, ","...)
+			}
+			for range cw.codecs {
+				buffer = append(buffer, ","...)
+			}
+			continue
+		}
+		blockstat := (*blockStats)[size]
+		buffer = append(buffer, toString(blockstat.DedupRate)...)
+		buffer = append(buffer, ","...)
+		if cw.bloomRates {
+			buffer = append(buffer, toString(blockstat.BloomDedupRate)...)
+			buffer = append(buffer, ","...)
+		}
+		buffer = append(buffer, toString(blockstat.IntraDedupRate)...)
+		buffer = append(buffer, ","...)
+		buffer = append(buffer, toString(blockstat.DataCompressionRatio)...)
+		buffer = append(buffer, ","...)
+		for _, codec := range cw.codecs {
+			buffer = append(buffer, toString(blockstat.CompressionRatios[codec])...)
+			buffer = append(buffer, ","...)
+		}
+		buffer = append(buffer, toString(blockstat.NewBlocks)...)
+		buffer = append(buffer, ","...)
+		buffer = append(buffer, toString(blockstat.CompressedGbPerDay)...)
+		buffer = append(buffer, ","...)
+	}
+	if cw.chunkAvg > 0 {
+		if chunkStats == nil {
+			buffer = append(buffer, ",,,"...)
+		} else {
+			for _, rate := range []float64{chunkStats.DedupRate, chunkStats.IntraDedupRate,
+				chunkStats.DataCompressionRatio} {
+				buffer = append(buffer, toString(rate)...)
+				buffer = append(buffer, ","...)
+			}
+		}
+	}
+	buffer = append(buffer, strings.Join(missing, ";")...)
+	buffer = append(buffer, '\n')
+
+	_, err := cw.w.Write(buffer)
+	return err
+}
+
+// writeBreakdown writes <iteration>-files.csv and <iteration>-databases.csv in dir. File paths and
+// namespaces can hold commas, quotes or newlines, so these are quoted as needed.
+func writeBreakdown(dir string, iteration int, breakdown *Breakdown) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	countsHeader := []string{"Blocks", "Bytes", "ChangedBytes", "DedupRate", "DataCompressionRate"}
+	counts := func(record []string, c BreakdownCounts) []string {
+		for _, val := range []interface{}{c.Blocks, c.Bytes, c.ChangedBytes, c.DedupRate, c.DataCompressionRatio} {
+			record = append(record, string(toString(val)))
+		}
+		return record
+	}
+
+	records := [][]string{append([]string{"File", "Database", "Namespace"}, countsHeader...)}
+	for _, f := range breakdown.Files {
+		records = append(records, counts([]string{f.File, f.Database, f.Namespace}, f.BreakdownCounts))
+	}
+	fname := filepath.Join(dir, fmt.Sprintf("%d-files.csv", iteration))
+	if err := writeCSVFile(fname, records); err != nil {
+		return err
+	}
+
+	records = [][]string{append([]string{"Database", "Files"}, countsHeader...)}
+	for _, db := range breakdown.Databases {
+		records = append(records, counts([]string{db.Database, strconv.Itoa(db.Files)}, db.BreakdownCounts))
+	}
+	fname = filepath.Join(dir, fmt.Sprintf("%d-databases.csv", iteration))
+	return writeCSVFile(fname, records)
+}
+
+func writeCSVFile(fname string, records [][]string) error {
+	var buffer bytes.Buffer
+	w := csv.NewWriter(&buffer)
+	if err := w.WriteAll(records); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, buffer.Bytes(), 0666)
+}
+
+// the report does not fit the csv columns. It is printed to stderr instead.
+func (cw *csvWriter) WriteReport(report *StorageReport) error {
+	return nil
+}
+
+func (cw *csvWriter) Close() error {
+	return nil
+}
+
+func toString(val interface{}) []byte {
+	var s string
+	switch v := val.(type) {
+	case int32:
+		s = strconv.FormatInt(int64(v), 10)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case int:
+		s = strconv.Itoa(v)
+	case float32:
+		s = strconv.FormatFloat(float64(v), 'f', 3, 32)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', 3, 64)
+	case string:
+		s = v
+	case bson.MongoTimestamp:
+		s = strconv.FormatInt(int64(v), 10)
+	}
+	return []byte(s)
+}
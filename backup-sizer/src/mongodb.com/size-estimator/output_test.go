@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	. "mongodb.com/size-estimator/components"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testIterations() []*IterationStats {
+	blockStats := AllBlockSizeStats{}
+	for _, bs := range blocksizes {
+		blockStats[bs] = &BlockStats{DedupRate: 0.5, BloomDedupRate: 0.5, DataCompressionRatio: 2,
+			CompressionRatios: map[string]float64{"zlib": 2, "snappy": 1.5}, NewBlocks: 10}
+	}
+	return []*IterationStats{
+		{
+			Iteration:  0,
+			Start:      time.Unix(0, 0),
+			OplogStats: &OplogStats{Size: 1 << 20, GbPerDay: 1},
+			SizeStats:  &SizeStats{DataSize: 1 << 20, IndexSize: 1 << 10, FileSize: 1 << 21},
+			BlockStats: &blockStats,
+			ChunkStats: &BlockStats{DedupRate: 0.25, DataCompressionRatio: 2},
+		},
+		// the blocks couldn't be hashed
+		{
+			Iteration:  1,
+			Start:      time.Unix(60, 0),
+			OplogStats: &OplogStats{Size: 1 << 20, GbPerDay: 1},
+			SizeStats:  &SizeStats{DataSize: 1 << 20, IndexSize: 1 << 10, FileSize: 1 << 21},
+			Missing:    []string{ComponentBlocks, ComponentChunks},
+		},
+	}
+}
+
+func TestCSVOutput(test *testing.T) {
+	compressors, err := ParseCompressors("zlib,snappy")
+	if err != nil {
+		test.Fatalf("Failed to parse compressors. Err: %v", err)
+	}
+	cases := []struct {
+		opts BackupSizingOpts
+		desc string
+	}{
+		{BackupSizingOpts{Output: OutputCSV}, "defaults"},
+		{BackupSizingOpts{Output: OutputCSV, DedupMode: DedupExact}, "bloom rates"},
+		{BackupSizingOpts{Output: OutputCSV, DedupMode: DedupSorted, BlockCompressors: compressors,
+			Chunking: NewChunkParams(0, 16*kb, 0)}, "bloom rates, codecs and chunks"},
+	}
+	for _, testCase := range cases {
+		var buffer bytes.Buffer
+		out, err := NewOutputWriter(&testCase.opts, &buffer)
+		if err != nil {
+			test.Fatalf("Failed to create the writer for %s. Err: %v", testCase.desc, err)
+		}
+		if err := out.WriteHeader(); err != nil {
+			test.Fatalf("Failed to write the header for %s. Err: %v", testCase.desc, err)
+		}
+		for _, stats := range testIterations() {
+			if err := out.WriteIteration(stats); err != nil {
+				test.Fatalf("Failed to write iteration %d for %s. Err: %v", stats.Iteration, testCase.desc, err)
+			}
+		}
+		if err := out.Close(); err != nil {
+			test.Fatalf("Failed to close the writer for %s. Err: %v", testCase.desc, err)
+		}
+
+		records, err := csv.NewReader(&buffer).ReadAll()
+		if err != nil {
+			test.Fatalf("Failed to read the csv for %s. Err: %v", testCase.desc, err)
+		}
+		if len(records) != 3 {
+			test.Fatalf("Expected a header and 2 rows for %s. Received %d records", testCase.desc, len(records))
+		}
+		header := records[0]
+		for i, record := range records[1:] {
+			if len(record) != len(header) {
+				test.Errorf("Expected %d fields in row %d for %s. Received %d: %v", len(header), i, testCase.desc,
+					len(record), record)
+			}
+		}
+		if missing := records[2][len(records[2])-1]; missing != "blocks;chunks" {
+			test.Errorf("Expected the missing components last for %s. Received %q", testCase.desc, missing)
+		}
+	}
+}
+
+func TestClusterCSVOutput(test *testing.T) {
+	var buffer bytes.Buffer
+	out, err := NewOutputWriter(&BackupSizingOpts{Output: OutputCSV, Cluster: true}, &buffer)
+	if err != nil {
+		test.Fatalf("Failed to create the writer. Err: %v", err)
+	}
+	stats := testIterations()[1]
+	stats.Shards = []*ShardStats{
+		{Shard: "shard0", OplogStats: stats.OplogStats, SizeStats: stats.SizeStats},
+		{Shard: "config", SizeStats: stats.SizeStats},
+	}
+	if err := out.WriteHeader(); err != nil {
+		test.Fatalf("Failed to write the header. Err: %v", err)
+	}
+	if err := out.WriteIteration(stats); err != nil {
+		test.Fatalf("Failed to write the iteration. Err: %v", err)
+	}
+
+	records, err := csv.NewReader(&buffer).ReadAll()
+	if err != nil {
+		test.Fatalf("Failed to read the csv. Err: %v", err)
+	}
+	if len(records) != 4 {
+		test.Fatalf("Expected a header, 2 shards and a total. Received %d records", len(records))
+	}
+	for i, shard := range []string{"Shard", "shard0", "config", clusterTotalRow} {
+		if records[i][0] != shard {
+			test.Errorf("Expected %s in the first column of row %d. Received %s", shard, i, records[i][0])
+		}
+	}
+}
+
+func TestJSONOutput(test *testing.T) {
+	iterations := testIterations()
+	report := &StorageReport{Iterations: len(iterations), OplogGbPerDay: 1, RecommendedBlockSize: 64 * kb}
+
+	for _, withReport := range []bool{true, false} {
+		var buffer bytes.Buffer
+		out, err := NewOutputWriter(&BackupSizingOpts{Output: OutputJSON}, &buffer)
+		if err != nil {
+			test.Fatalf("Failed to create the writer. Err: %v", err)
+		}
+		writeOutput(test, out, iterations, report, withReport)
+
+		var document struct {
+			Iterations []*IterationStats
+			Report     *StorageReport
+		}
+		if err := json.Unmarshal(buffer.Bytes(), &document); err != nil {
+			test.Fatalf("Failed to decode the json with report %v. Err: %v\n%s", withReport, err, buffer.String())
+		}
+		if len(document.Iterations) != len(iterations) {
+			test.Errorf("Expected %d iterations. Received %d", len(iterations), len(document.Iterations))
+		}
+		if withReport != (document.Report != nil) {
+			test.Errorf("Expected a report: %v. Received %+v", withReport, document.Report)
+		}
+		checkDecoded(test, document.Iterations)
+	}
+}
+
+func TestNDJSONOutput(test *testing.T) {
+	iterations := testIterations()
+	report := &StorageReport{Iterations: len(iterations), OplogGbPerDay: 1, RecommendedBlockSize: 64 * kb}
+
+	var buffer bytes.Buffer
+	out, err := NewOutputWriter(&BackupSizingOpts{Output: OutputNDJSON}, &buffer)
+	if err != nil {
+		test.Fatalf("Failed to create the writer. Err: %v", err)
+	}
+	writeOutput(test, out, iterations, report, true)
+
+	decoded := make([]*IterationStats, 0)
+	scanner := bufio.NewScanner(&buffer)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		line := scanner.Bytes()
+		if lines > len(iterations) {
+			var record struct{ Report *StorageReport }
+			if err := json.Unmarshal(line, &record); err != nil || record.Report == nil {
+				test.Fatalf("Failed to decode the report from %s. Err: %v", line, err)
+			}
+			if record.Report.Iterations != report.Iterations {
+				test.Errorf("Expected %d iterations in the report. Received %d", report.Iterations,
+					record.Report.Iterations)
+			}
+			continue
+		}
+		var stats IterationStats
+		if err := json.Unmarshal(line, &stats); err != nil {
+			test.Fatalf("Failed to decode line %d. Err: %v\n%s", lines, err, line)
+		}
+		decoded = append(decoded, &stats)
+	}
+	if lines != len(iterations)+1 {
+		test.Errorf("Expected %d lines. Received %d", len(iterations)+1, lines)
+	}
+	checkDecoded(test, decoded)
+}
+
+func writeOutput(test *testing.T, out OutputWriter, iterations []*IterationStats, report *StorageReport,
+	withReport bool) {
+	if err := out.WriteHeader(); err != nil {
+		test.Fatalf("Failed to write the header. Err: %v", err)
+	}
+	for _, stats := range iterations {
+		if err := out.WriteIteration(stats); err != nil {
+			test.Fatalf("Failed to write iteration %d. Err: %v", stats.Iteration, err)
+		}
+	}
+	if withReport {
+		if err := out.WriteReport(report); err != nil {
+			test.Fatalf("Failed to write the report. Err: %v", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		test.Fatalf("Failed to close the writer. Err: %v", err)
+	}
+}
+
+func checkDecoded(test *testing.T, decoded []*IterationStats) {
+	if len(decoded) != 2 {
+		return
+	}
+	if decoded[0].BlockStats == nil || (*decoded[0].BlockStats)[64*kb].DedupRate != 0.5 {
+		test.Errorf("Expected the block stats of iteration 0. Received %+v", decoded[0].BlockStats)
+	}
+	if decoded[1].BlockStats != nil || strings.Join(decoded[1].Missing, ";") != "blocks;chunks" {
+		test.Errorf("Expected iteration 1 without block stats. Received %+v", decoded[1])
+	}
+}
+
+func TestWriteBreakdown(test *testing.T) {
+	dir, err := ioutil.TempDir("", "breakdown")
+	if err != nil {
+		test.Fatalf("Failed to create temp dir. Err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	counts := BreakdownCounts{Blocks: 4, Bytes: 4 * 64 * kb, ChangedBytes: 64 * kb, DedupRate: 0.75}
+	breakdown := &Breakdown{
+		BlockSize: 64 * kb,
+		Files: []*FileStats{
+			{File: "collection-2-1.wt", Database: "a,b", Namespace: "a,b.c \"d\"\ne", BreakdownCounts: counts},
+			{File: "WiredTiger.wt", Database: "(other)", BreakdownCounts: counts},
+		},
+		Databases: []*DatabaseStats{{Database: "a,b", Files: 1, BreakdownCounts: counts}},
+	}
+	if err := writeBreakdown(dir, 3, breakdown); err != nil {
+		test.Fatalf("Failed to write the breakdown. Err: %v", err)
+	}
+
+	for name, expected := range map[string][][]string{
+		"3-files.csv": {
+			{"collection-2-1.wt", "a,b", "a,b.c \"d\"\ne"},
+			{"WiredTiger.wt", "(other)", ""},
+		},
+		"3-databases.csv": {{"a,b", "1"}},
+	} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			test.Fatalf("Failed to open %s. Err: %v", name, err)
+		}
+		records, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			test.Fatalf("Failed to read %s. Err: %v", name, err)
+		}
+		if len(records) != len(expected)+1 {
+			test.Fatalf("Expected a header and %d rows in %s. Received %v", len(expected), name, records)
+		}
+		for i, record := range records[1:] {
+			if len(record) != len(records[0]) {
+				test.Errorf("Expected %d fields in row %d of %s. Received %v", len(records[0]), i, name, record)
+				continue
+			}
+			for j, field := range expected[i] {
+				if record[j] != field {
+					test.Errorf("Expected %q in row %d of %s. Received %q", field, i, name, record[j])
+				}
+			}
+			if rate := record[len(record)-2]; rate != "0.750" {
+				test.Errorf("Expected dedup rate 0.750 in row %d of %s. Received %s", i, name, rate)
+			}
+		}
+	}
+}
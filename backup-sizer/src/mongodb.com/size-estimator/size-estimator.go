@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"gopkg.in/mgo.v2/bson"
 	. "mongodb.com/size-estimator/components"
 	"os"
-	"reflect"
+	"os/signal"
 	"runtime"
-	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -21,6 +23,11 @@ const (
 	DefaultIter         = 12
 	DefaultHashDir      = "hashes"
 	DefaultFalsePosRate = 0.01
+	DefaultDigestSize   = 32
+	DefaultDedupWindow  = 1
+	DefaultOutput       = OutputCSV
+
+	DefaultMaxConsecutiveFailures = 3
 )
 
 var (
@@ -41,58 +48,371 @@ func NewOptionsFromCmdLine() BackupSizingOpts {
 	opts := BackupSizingOpts{}
 	flag.StringVar(&opts.Host, "host", DefaultHostName, "Hostname to ping")
 	flag.IntVar(&opts.Port, "port", DefaultPort, "Port for the offline agent to ping")
+	flag.StringVar(&opts.Uri, "uri", "", "MongoDB connection string. Overrides -host and -port")
+	flag.StringVar(&opts.Username, "username", "", "Username to authenticate as")
+	flag.StringVar(&opts.Password, "password", "", "Password to authenticate with")
+	flag.StringVar(&opts.AuthDB, "authenticationDatabase", "", "Database holding the user's credentials")
+	flag.StringVar(&opts.AuthMechanism, "authenticationMechanism", "",
+		"Authentication mechanism: SCRAM-SHA-1, MONGODB-CR or MONGODB-X509")
+	flag.DurationVar(&opts.DialTimeout, "dialTimeout", 10*time.Second, "How long to wait to connect to the server")
+	flag.DurationVar(&opts.SocketTimeout, "socketTimeout", time.Minute, "How long to wait for a server reply")
+	flag.BoolVar(&opts.SSL, "ssl", false, "Connect using TLS/SSL")
+	flag.StringVar(&opts.SSLCAFile, "sslCAFile", "", "Certificate authority file used to verify the server")
+	flag.StringVar(&opts.SSLPEMKeyFile, "sslPEMKeyFile", "", "File holding the client certificate and key")
+	flag.BoolVar(&opts.SSLAllowInvalidHostnames, "sslAllowInvalidHostnames", false,
+		"Do not check that the server certificate matches its hostname")
+	flag.BoolVar(&opts.SSLAllowInvalidCertificates, "sslAllowInvalidCertificates", false,
+		"Do not verify the server certificate")
 	flag.DurationVar(&opts.SleepTime, "interval", DefaultSleepTime, "How long to sleep between iterations")
 	flag.IntVar(&opts.NumIter, "iterations", DefaultIter, "Number of iterations")
 	flag.StringVar(&opts.HashDir, "hashDir", DefaultHashDir, "Directory to store block hashes")
+	flag.IntVar(&opts.DigestSize, "hashBytes", DefaultDigestSize,
+		"Bytes of each block's SHA-256 digest to store. Fewer bytes use less disk but may report false duplicates")
+	convertHashes := flag.Bool("convertHashes", false,
+		"Convert text hash files in hashDir to the binary format and exit")
 	flag.Float64Var(&opts.FalsePosRate, "falsePos", DefaultFalsePosRate, "False positive rate for duplicated hashes")
+	dedupMode := flag.String("dedupMode", string(DedupBloom),
+		"How to find blocks unchanged since the previous iteration: bloom, exact or sorted. exact holds the "+
+			"hash of every block in the dedup window and the iteration in memory, so the dbpath it can measure is "+
+			"bounded by RAM. sorted gets the same results from an external sort of the hash files on disk")
+	flag.IntVar(&opts.DedupWindow, "dedupWindow", DefaultDedupWindow,
+		"Number of previous iterations a block is deduplicated against. 0 for every previous iteration")
+	blockCompressors := flag.String("blockCompressors", CodecZlib,
+		"Comma separated codecs to measure block compression with: zlib, gzip, flate or snappy. zlib, gzip and "+
+			"flate take a level, e.g. zlib:9. The first one is used for the storage report")
+	oplogCompressor := flag.String("oplogCompressor", CodecSnappy, "Codec to measure oplog compression with")
+	cdcAvg := flag.Int("cdcAvg", 0, "Average size of content defined chunks to measure alongside the fixed "+
+		"block sizes. Must be a power of two. Chunking reads the data files a second time. 0 disables it")
+	cdcMin := flag.Int("cdcMin", 0, "Minimum content defined chunk size. Defaults to a quarter of -cdcAvg")
+	cdcMax := flag.Int("cdcMax", 0, "Maximum content defined chunk size. Defaults to four times -cdcAvg")
+	flag.BoolVar(&opts.Breakdown, "breakdown", false, "Break the dedup and compression of the smallest block "+
+		"size down by file and database. With csv output it is written to hashDir/breakdown")
 	flag.IntVar(&opts.NumCPUs, "numCPUs", runtime.NumCPU(), "Max number of CPUs to use")
+	flag.IntVar(&opts.NumSplitters, "numSplitters", 3, "Number of files read at the same time")
+	flag.IntVar(&opts.NumHashers, "numHashers", 0, "Number of goroutines hashing and compressing blocks. "+
+		"Defaults to -numCPUs")
+	flag.Float64Var(&opts.MaxReadMBps, "maxReadMBps", 0, "Cap on the rate data files are read at, in MB/s. "+
+		"0 for no cap")
+	flag.BoolVar(&opts.Cluster, "cluster", false,
+		"Connect to a mongos and collect oplog and size stats from every shard and the config servers. "+
+			"Without block stats, the storage report assumes full, uncompressed snapshots")
+	flag.StringVar(&opts.Member, "member", "", "Replica set member to analyze: primary, secondary, hidden or host:port. "+
+		"Its dbpath must be on this host")
+	flag.BoolVar(&opts.Offline, "offline", false, "Only analyze the blocks in -dbpath, without contacting a server")
+	flag.StringVar(&opts.DbPath, "dbpath", "", "Data directory to analyze when running offline")
+	storageEngine := flag.String("storageEngine", "",
+		"Storage engine of -dbpath when running offline: wiredTiger or mmapv1. Detected from the files if not set")
+	flag.BoolVar(&opts.Resume, "resume", false, "Continue a previous run saved in hashDir instead of starting over")
+	flag.IntVar(&opts.Retry.Attempts, "retries", DefaultRetryPolicy.Attempts,
+		"Attempts at each server command before an iteration goes without its results. Setup errors, like "+
+			"failed authentication, are not retried")
+	flag.DurationVar(&opts.Retry.InitialBackoff, "retryBackoff", DefaultRetryPolicy.InitialBackoff,
+		"Wait before the first retry. It doubles with every attempt")
+	opts.Retry.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	flag.IntVar(&opts.MaxConsecutiveFailures, "maxConsecutiveFailures", DefaultMaxConsecutiveFailures,
+		"Number of iterations in a row that can be missing results before the run is aborted")
+	progressInterval := flag.Duration("progressInterval", DefaultProgressInterval,
+		"How often to print the progress of hashing the data files. 0 disables it")
+	flag.StringVar(&opts.Output, "output", DefaultOutput, "Output format for iteration results: csv, json or ndjson")
+
+	sched := DefaultSnapshotSchedule
+	flag.DurationVar(&opts.Schedule.Interval, "snapshotInterval", sched.Interval, "Time between snapshots")
+	flag.DurationVar(&opts.Schedule.Retention, "snapshotRetention", sched.Retention, "How long every snapshot is kept")
+	flag.IntVar(&opts.Schedule.DailyRetention, "dailyRetention", sched.DailyRetention, "Days to keep daily snapshots")
+	flag.IntVar(&opts.Schedule.WeeklyRetention, "weeklyRetention", sched.WeeklyRetention, "Weeks to keep weekly snapshots")
+	flag.IntVar(&opts.Schedule.MonthlyRetention, "monthlyRetention", sched.MonthlyRetention,
+		"Months to keep monthly snapshots")
+	flag.DurationVar(&opts.Schedule.PointInTimeWindow, "pitWindow", sched.PointInTimeWindow,
+		"Point in time restore window")
 	flag.Parse()
 
-	opts.Uri = fmt.Sprintf("%s:%d", opts.Host, opts.Port)
+	if opts.Uri == "" {
+		opts.Uri = fmt.Sprintf("%s:%d", opts.Host, opts.Port)
+	}
+	if err := ValidateDigestSize(opts.DigestSize); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *convertHashes {
+		n, err := ConvertHashDir(opts.HashDir, opts.DigestSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to convert hash files in %s. Err: %v\n", opts.HashDir, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Converted %d hash files in %s.\n", n, opts.HashDir)
+		os.Exit(0)
+	}
+	if opts.NumSplitters < 1 || opts.NumHashers < 0 || opts.MaxReadMBps < 0 {
+		fmt.Fprintf(os.Stderr, "Need at least one splitter and no negative hashers or read rate. Received %d, %d, %v\n",
+			opts.NumSplitters, opts.NumHashers, opts.MaxReadMBps)
+		os.Exit(1)
+	}
+	if opts.Retry.Attempts < 1 || opts.MaxConsecutiveFailures < 1 {
+		fmt.Fprintf(os.Stderr, "Need at least one attempt and one failure before aborting. Received %d, %d\n",
+			opts.Retry.Attempts, opts.MaxConsecutiveFailures)
+		os.Exit(1)
+	}
+	if opts.DedupWindow < 0 {
+		fmt.Fprintf(os.Stderr, "Dedup window %d cannot be negative\n", opts.DedupWindow)
+		os.Exit(1)
+	}
+	mode, err := ParseDedupMode(*dedupMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts.DedupMode = mode
+	opts.BlockCompressors, err = ParseCompressors(*blockCompressors)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts.OplogCompressor, err = ParseCompressor(*oplogCompressor)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *cdcAvg != 0 {
+		opts.Chunking = NewChunkParams(*cdcMin, *cdcAvg, *cdcMax)
+		if err := opts.Chunking.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *progressInterval > 0 {
+		opts.ProgressInterval = *progressInterval
+		opts.ProgressFunc = printProgress
+	}
+	if *storageEngine != "" {
+		se, err := ParseStorageEngine(*storageEngine)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts.StorageEngine = se
+	}
 
 	return opts
 }
 
+func printProgress(p Progress) {
+	status := "Hashing"
+	if p.Done {
+		status = "Hashed"
+	}
+	eta := ""
+	if !p.Done && p.ETA > 0 {
+		eta = fmt.Sprintf(", ETA %v", p.ETA.Truncate(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, "%s %s of %d/%d files, %.1f/%.1f MB in %v at %.1f MB/s%s\n", status, p.Pass, p.Files,
+		p.TotalFiles, float64(p.Bytes)/mb, float64(p.TotalBytes)/mb, p.Elapsed.Truncate(time.Second),
+		p.BytesPerSec/mb, eta)
+}
+
 func main() {
 	opts = NewOptionsFromCmdLine()
 
 	runtime.GOMAXPROCS(opts.NumCPUs)
 
-	fmt.Printf("Running on port %s every %v for %d iterations.\n", opts.Uri, opts.SleepTime, opts.NumIter)
-
-	session := opts.GetSession()
-	defer session.Close()
-
-	err := session.Ping()
+	out, err := NewOutputWriter(&opts, os.Stdout)
 	if err != nil {
-		fmt.Printf("Failed to contact server on %s. Err %v\n", opts.Uri, err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Successfully connected to %s\n", opts.Uri)
-
-	exists, err := CheckExists(opts.HashDir)
-	if err != nil {
-		fmt.Printf("Failure checking directory %s exists. Err %v\n", opts.HashDir, err)
+	if err := opts.Schedule.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	if exists {
-		err := os.RemoveAll(opts.HashDir)
+
+	if opts.Offline {
+		if opts.DbPath == "" {
+			fmt.Fprintln(os.Stderr, "Running offline requires -dbpath")
+			os.Exit(1)
+		}
+		se, err := opts.GetStorageEngine()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to determine the storage engine of %s. Err: %v\n", opts.DbPath, err)
+			os.Exit(1)
+		}
+		opts.StorageEngine = se
+		fmt.Fprintf(os.Stderr, "Running offline on %s every %v for %d iterations.\n", opts.DbPath, opts.SleepTime,
+			opts.NumIter)
+	} else {
+		fmt.Fprintf(os.Stderr, "Running on port %s every %v for %d iterations.\n", opts.SafeUri(), opts.SleepTime,
+			opts.NumIter)
+
+		if err := checkSetup(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Successfully connected to %s\n", opts.SafeUri())
+	}
+
+	var state *RunState
+	if opts.Resume {
+		state, err = LoadRunState(opts.HashDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failure loading saved run from %s. Err %v\n", opts.HashDir, err)
+			os.Exit(1)
+		}
+		if state == nil {
+			fmt.Fprintf(os.Stderr, "No saved run found in %s. Starting a new run.\n", opts.HashDir)
+		}
+	}
+
+	if state != nil {
+		if err := state.CheckCompatible(&opts, blocksizes); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot resume saved run in %s. Err %v\n", opts.HashDir, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Resuming at iteration %d.\n", state.NextIteration())
+	} else {
+		exists, err := CheckExists(opts.HashDir)
 		if err != nil {
-			fmt.Printf("Failure removing directory %s. Err %v\n", opts.HashDir, err)
+			fmt.Fprintf(os.Stderr, "Failure checking directory %s exists. Err %v\n", opts.HashDir, err)
+			os.Exit(1)
 		}
+		if exists {
+			err := os.RemoveAll(opts.HashDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failure removing directory %s. Err %v\n", opts.HashDir, err)
+			}
+		}
+		state = NewRunState(&opts, blocksizes)
+	}
+	// stop at the next opportunity on ^C or kill, rather than leaving half written hash files
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "Received %v. Stopping.\n", sig)
+		cancel()
+		signal.Stop(signals)
+	}()
+
+	if err := Run(ctx, out, state); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if ctx.Err() != nil {
+		os.Exit(130)
+	}
+}
+
+// checkSetup connects once before the first iteration, so a wrong server, member or password stops
+// the run straight away rather than failing every iteration.
+func checkSetup() error {
+	client, err := NewClient(opts)
+	if err != nil {
+		return fmt.Errorf("Failed to contact server on %s. Err %v", opts.SafeUri(), err)
+	}
+	defer client.Close()
+
+	if opts.Cluster {
+		isMongos, err := IsMongos(client.Session())
+		if err != nil || !isMongos {
+			return fmt.Errorf("Cluster mode requires a mongos. %s is not one. Err: %v", opts.SafeUri(), err)
+		}
+		return nil
 	}
-	Run()
+	if _, err := client.DbPath(); err != nil {
+		return fmt.Errorf("Failed to get directory path for session on server %s. Err: %v", opts.SafeUri(), err)
+	}
+	return nil
 }
 
-func Run() {
-	printFields()
+// Run stops between iterations, or during one, when ctx is done. The iterations that finished are still
+// written, followed by a report on them.
+func Run(ctx context.Context, out OutputWriter, state *RunState) error {
+	if err := out.WriteHeader(); err != nil {
+		return fmt.Errorf("Failed to write output header. Err: %v", err)
+	}
 
-	for iter := 0; iter < opts.NumIter; iter++ {
+	// replay the iterations of a resumed run so the output is complete
+	for _, stats := range state.Results {
+		if err := out.WriteIteration(stats); err != nil {
+			return fmt.Errorf("Failed to write results for iteration %d. Err: %v", stats.Iteration, err)
+		}
+	}
+
+	next := state.NextIteration()
+	if next > 0 {
+		sleep(ctx, RemainingSleepTime(state.Results[next-1].Start))
+	}
+	state.NumIter = opts.NumIter
+	state.SleepTime = opts.SleepTime
+
+	var iterErr error
+	failures := 0
+	for iter := next; iter < opts.NumIter && ctx.Err() == nil; iter++ {
 		start := time.Now()
-		Iterate(iter)
-		sleep := RemainingSleepTime(start)
-		time.Sleep(sleep)
+		stats, err := Iterate(ctx, iter)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			failures++
+			fmt.Fprintf(os.Stderr, "Iteration %d is missing %s. Err: %v\n", iter, strings.Join(stats.Missing, ", "),
+				err)
+		} else {
+			failures = 0
+		}
+		stats.Start = start
+		state.Results = append(state.Results, stats)
+		if err := state.Save(opts.HashDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save run state for iteration %d. Err: %v\n", iter, err)
+		}
+		if err := out.WriteIteration(stats); err != nil {
+			return fmt.Errorf("Failed to write results for iteration %d. Err: %v", iter, err)
+		}
+		if failures > 0 && failures >= opts.MaxConsecutiveFailures {
+			iterErr = fmt.Errorf("Giving up after %d iterations in a row failed", failures)
+			break
+		}
+		if iter == opts.NumIter-1 {
+			break
+		}
+		sleep(ctx, RemainingSleepTime(start))
+	}
+
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted after %d of %d iterations. Reporting on the finished ones.\n",
+			len(state.Results), opts.NumIter)
+		iterErr = nil
+	}
+	if len(state.Results) > 0 {
+		writeReport(out, state.Results)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("Failed to finish writing output. Err: %v", err)
+	}
+	return iterErr
+}
+
+// sleep returns early when ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func writeReport(out OutputWriter, results []*IterationStats) {
+	report, err := NewStorageReport(results, opts.SleepTime, opts.Schedule)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create storage report. Err: %v\n", err)
+		return
+	}
+	if err := report.WriteText(os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print storage report. Err: %v\n", err)
+	}
+	if err := out.WriteReport(report); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write storage report. Err: %v\n", err)
 	}
 }
 
@@ -100,117 +420,167 @@ func RemainingSleepTime(start time.Time) time.Duration {
 	return opts.SleepTime - time.Now().Sub(start)
 }
 
-func Iterate(iter int) {
-	session := opts.GetSession()
-	defer session.Close()
-
-	oplogStats, err := GetOplogStats(session, opts.SleepTime)
+// Iterate collects every component it can. A component that fails, after retrying the server
+// commands it needs, is left out and listed in Missing, and the failures are returned along with the
+// rest of the stats.
+func Iterate(ctx context.Context, iter int) (*IterationStats, error) {
+	stats := &IterationStats{Iteration: iter}
+	var failures iterationFailures
+
+	var client *Client
+	err := Retry(ctx, opts.Retry, func() (err error) {
+		client, err = NewClient(opts)
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Failed to get oplog stats on server %s. Err: %v\n", opts.Uri, err)
-		os.Exit(1)
+		failures.add(stats, err, ComponentOplog, ComponentSize, ComponentBlocks, ComponentChunks,
+			ComponentBreakdown)
+		return stats, failures.err()
+	}
+	defer client.Close()
+
+	// a failed command may leave the session on a socket to a stepped down primary
+	retry := func(fn func() error) error {
+		return Retry(ctx, opts.Retry, func() error {
+			err := fn()
+			if err != nil {
+				client.Refresh()
+			}
+			return err
+		})
 	}
 
-	sizeStats, err := GetSizeStats(session)
-	if err != nil {
-		fmt.Printf("Failed to get sizing stats on server %s. Err: %v\n", opts.Uri, err)
-		os.Exit(1)
+	if opts.Cluster {
+		var clusterStats *ClusterStats
+		err := retry(func() (err error) {
+			clusterStats, err = client.ClusterStats(ctx)
+			return err
+		})
+		if err != nil {
+			failures.add(stats, fmt.Errorf("Failed to get cluster stats through %s. Err: %v", opts.SafeUri(), err),
+				ComponentOplog, ComponentSize)
+			return stats, failures.err()
+		}
+		// the shards' files are not local, so there are no block stats
+		stats.OplogStats = clusterStats.OplogStats
+		stats.SizeStats = clusterStats.SizeStats
+		stats.Shards = clusterStats.Shards
+		return stats, nil
 	}
 
-	dbpath, err := GetDbPath(session)
-	if err != nil {
-		fmt.Printf("Failed to get directory path for session on server %s. Err:%v\n", opts.Uri, err)
-		os.Exit(1)
+	// the oplog and dbStats need a server. Offline, only the files in dbpath are looked at.
+	if !opts.Offline {
+		err = retry(func() (err error) {
+			stats.OplogStats, err = client.OplogStats(ctx)
+			return err
+		})
+		if err != nil {
+			failures.add(stats, fmt.Errorf("Failed to get oplog stats on server %s. Err: %v", opts.SafeUri(), err),
+				ComponentOplog)
+		}
 	}
 
-	blockStats, err := GetBlockHashes(&opts, dbpath, blocksizes, iter)
+	err = retry(func() (err error) {
+		stats.SizeStats, err = client.SizeStats(ctx)
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Failed to get block hashes on server %s. Err %v\n", opts.Uri, err)
-		os.Exit(1)
+		failures.add(stats, fmt.Errorf("Failed to get sizing stats on %s. Err: %v", location(), err),
+			ComponentSize)
 	}
-	stats := []interface{}{
-		oplogStats,
-		sizeStats,
-		blockStats,
+
+	var dbpath string
+	err = retry(func() (err error) {
+		dbpath, err = client.DbPath()
+		return err
+	})
+	if err != nil {
+		failures.add(stats, fmt.Errorf("Failed to get directory path for session on server %s. Err:%v",
+			opts.SafeUri(), err), ComponentBlocks, ComponentChunks, ComponentBreakdown)
+		return stats, failures.err()
 	}
 
-	printVals(&stats)
-}
+	stats.BlockStats, err = client.BlockHashes(ctx, blocksizes, iter)
+	if err != nil {
+		failures.add(stats, fmt.Errorf("Failed to get block hashes in %s. Err %v", dbpath, err), ComponentBlocks,
+			ComponentBreakdown)
+	}
 
-func printFields() {
-	allStats := []interface{}{
-		&OplogStats{},
-		&SizeStats{},
+	if opts.Chunking.Enabled() {
+		stats.ChunkStats, err = client.ChunkHashes(ctx, iter)
+		if err != nil {
+			failures.add(stats, fmt.Errorf("Failed to get chunk hashes in %s. Err %v", dbpath, err), ComponentChunks)
+		}
+	}
+	if noPrevHashes(stats) {
+		stats.Missing = append(stats.Missing, ComponentDedup)
 	}
 
-	var buffer []byte
-	for _, stats := range allStats {
+	if opts.Breakdown && stats.BlockStats != nil {
+		var idents map[string]string
+		err = retry(func() (err error) {
+			idents, err = client.IdentNamespaces()
+			return err
+		})
+		if err != nil {
+			// the files are still broken down, just not by collection
+			fmt.Fprintf(os.Stderr, "Failed to map WiredTiger files to collections on server %s. Err: %v\n",
+				opts.SafeUri(), err)
+		}
+		stats.Breakdown, err = client.Breakdown(stats.BlockStats, idents)
+		if err != nil {
+			failures.add(stats, fmt.Errorf("Failed to break block stats down by file in %s. Err: %v", dbpath, err),
+				ComponentBreakdown)
+		}
+	}
 
-		s := reflect.ValueOf(stats).Elem()
+	return stats, failures.err()
+}
 
-		for i := 0; i < s.NumField(); i++ {
-			buffer = append(buffer, s.Type().Field(i).Name...)
-			buffer = append(buffer, ',')
+// noPrevHashes is true when the previous iterations failed, so the blocks could not be deduped.
+func noPrevHashes(stats *IterationStats) bool {
+	if stats.ChunkStats != nil && stats.ChunkStats.NoPrevHashes {
+		return true
+	}
+	if stats.BlockStats == nil {
+		return false
+	}
+	for _, stat := range *stats.BlockStats {
+		if stat.NoPrevHashes {
+			return true
 		}
 	}
+	return false
+}
 
-	// this is just going to have to be hardcoded for now.
-	for _, bs := range blocksizes {
-		s := fmt.Sprintf("DedupRate(%d),DataCompressionRate(%d),", bs, bs)
-		buffer = append(buffer, s...)
+// location is the server, or the dbpath when running offline.
+func location() string {
+	if opts.Offline {
+		return opts.DbPath
 	}
-
-	fmt.Println(string(buffer[0 : len(buffer)-1]))
+	return "server " + opts.SafeUri()
 }
 
-func toString(val interface{}) []byte {
-	var s string
-	switch val.(type) {
-	case int32, int64:
-		s = strconv.FormatInt(val.(int64), 10)
-	case int:
-		s = strconv.Itoa(val.(int))
-	case float32:
-		s = strconv.FormatFloat(val.(float64), 'f', 3, 32)
-	case float64:
-		s = strconv.FormatFloat(val.(float64), 'f', 3, 64)
-	case string:
-		s = val.(string)
-	default:
-		strname := reflect.TypeOf(val).Name()
-		switch strname {
-		case "MongoTimestamp":
-			s = strconv.FormatInt(int64(val.(bson.MongoTimestamp)), 10)
-		}
-	}
-	return []byte(s)
-}
+// iterationFailures collects the errors of the components missing from an iteration.
+type iterationFailures []error
 
-func printVals(allStats *[]interface{}) {
-	var buffer []byte
-
-	for _, stats := range *allStats {
-		v := reflect.ValueOf(stats)
-		s := v.Elem()
-
-		if s.Kind() == reflect.Map {
-			blockStatsMapPtr := stats.(*AllBlockSizeStats)
-			for _, size := range blocksizes {
-				blockstat := (*blockStatsMapPtr)[size]
-				buffer = append(buffer, toString(blockstat.DedupRate)...)
-				buffer = append(buffer, ","...)
-				buffer = append(buffer, toString(blockstat.DataCompressionRatio)...)
-				buffer = append(buffer, ","...)
-			}
-		} else {
-			for i := 0; i < s.NumField(); i++ {
-				f := s.Field(i)
-				val := f.Interface()
-				buffer = append(buffer, toString(val)...)
-				buffer = append(buffer, ',')
-			}
+func (failures *iterationFailures) add(stats *IterationStats, err error, components ...string) {
+	*failures = append(*failures, err)
+	for _, c := range components {
+		if (c == ComponentChunks && !opts.Chunking.Enabled()) || (c == ComponentBreakdown && !opts.Breakdown) {
+			continue
 		}
+		stats.Missing = append(stats.Missing, c)
+	}
+}
+
+func (failures iterationFailures) err() error {
+	if len(failures) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(failures))
+	for i, err := range failures {
+		msgs[i] = err.Error()
 	}
-	str := string(buffer[0 : len(buffer)-1])
-	fmt.Println(str)
-	return
+	return errors.New(strings.Join(msgs, "\n"))
 }